@@ -0,0 +1,258 @@
+package archive
+
+import (
+	"./entries"
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// AppendOptions configures AppendImage.
+type AppendOptions struct {
+	// The archive, open for reading and writing
+	File *os.File
+	// Contents of the image, Size bytes.  All zero clusters are left
+	// unallocated.
+	Image io.ReaderAt
+	Size  int64
+	// Treat anomalies in the archive as errors
+	Strict bool
+	// Write 8 byte cluster indices, with a WideClusters entry in the
+	// ending.  Images of more than 2^31 clusters have them anyway.
+	WideClusters bool
+}
+
+// AppendImage adds an image after the newest one, as a device writing
+// to the archive would.  Clusters are of the size in the header.  The
+// end pointers are updated last, one at a time, so the archive is
+// readable if this is interrupted.  RandReaderInit must have been
+// called, because endings are padded with random data.
+func AppendImage(options *AppendOptions) error {
+	var header entries.ArchiveHeaderRead
+	readOptions := &ExtractOptions{File: options.File, Strict: options.Strict}
+	if _, err := options.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := ReadHeader(readOptions, &header); err != nil {
+		return err
+	}
+	if err := checkArchiveHeader(readOptions, &header, header.CvtmMagic.HeaderLength, false); err != nil {
+		return err
+	}
+	// Entries are only written little-endian
+	if byteOrder(&header) != binary.LittleEndian {
+		return errors.New("Can only append to little-endian archives")
+	}
+
+	if header.ImageBasic.ImgCipher != ImgCipherNull {
+		return errors.New("Writing encrypted images isn't supported")
+	}
+	if header.ImgCompression.Algo != ImgCompressionNone {
+		return errors.New("Writing compressed images isn't supported")
+	}
+	var publicKey *rsa.PublicKey
+	if header.EndingCipher.Algo == EndingCipherRSA {
+		var err error
+		if publicKey, err = x509.ParsePKCS1PublicKey(header.EndingCipher.Key); err != nil {
+			return fmt.Errorf("Bad public key in archive %v", err)
+		}
+	}
+
+	// The new image starts where the newest ending ends
+
+	endAt, prevBlocks, endErrs := findEnd(options.File, &header)
+	if endAt == 0 {
+		return append(errorList{ErrNoEndPointer}, endErrs...)
+	}
+	blockExp := blockSizeExp(&header)
+	blockSize := int64(1) << blockExp
+	areaEnd := int64(header.ImageArea.End) << blockExp
+	if endAt < int64(header.ImageArea.Start)<<blockExp || endAt > areaEnd {
+		return fmt.Errorf("%w, newest ending is outside of image area at %d", ErrBadEnding, endAt)
+	}
+	endingBytes := blockSize * int64(header.EndingSize.Size)
+
+	if int(blockExp)+int(header.ImageBasic.ImgClusterSizeExp) > 9+maxClusterSizeExp {
+		return fmt.Errorf("Cluster size exponent too big %d", header.ImageBasic.ImgClusterSizeExp)
+	}
+	clusterExp := blockExp + header.ImageBasic.ImgClusterSizeExp
+	clusterSize := int64(1) << clusterExp
+
+	dataClusterCount := (options.Size + clusterSize - 1) >> clusterExp
+	// 4 byte indices can only number 2^31 clusters
+	wide := options.WideClusters || dataClusterCount > 0x7fffffff
+	indexSize := 4
+	if wide {
+		indexSize = 8
+	}
+	perL2 := clusterSize / int64(indexSize)
+	l1 := make([]int64, (dataClusterCount+perL2-1)/perL2)
+	clustersOffset := (int64(indexSize*len(l1)) + blockSize - 1) >> blockExp
+
+	start := endAt
+	clustersStart := start + clustersOffset<<blockExp
+
+	// Clusters are written in order.  Each L2 table comes before its
+	// data clusters, and is written once they are placed.
+	nextCluster := int64(0)
+	allocate := func() (int64, error) {
+		if clustersStart+(nextCluster+1)<<clusterExp+endingBytes > areaEnd {
+			return 0, ErrArchiveFull
+		}
+		nextCluster++
+		return nextCluster - 1, nil
+	}
+
+	checkAlgo := header.ClusterCheck.Algo
+	if checkAlgo != ClusterCheckNone {
+		if _, err := computeClusterChecksum(nil, checkAlgo); err != nil {
+			return err
+		}
+	}
+
+	data := make([]byte, clusterSize)
+	l2 := make([]int64, perL2)
+	sums := make([]int64, perL2)
+	for i := range l1 {
+		l1[i] = -1
+		for j := range l2 {
+			l2[j] = -1
+			sums[j] = 0
+			n := int64(i)*perL2 + int64(j)
+			if n >= dataClusterCount {
+				continue
+			}
+
+			// The last cluster may be short
+			chunk := data
+			if rest := options.Size - n<<clusterExp; rest < clusterSize {
+				chunk = data[:rest]
+				for k := rest; k < clusterSize; k++ {
+					data[k] = 0
+				}
+			}
+			if err := readFullAt(options.Image, chunk, n<<clusterExp); err != nil {
+				return err
+			}
+			if isZero(data) {
+				continue
+			}
+
+			if l1[i] < 0 {
+				at, err := allocate()
+				if err != nil {
+					return err
+				}
+				l1[i] = at
+				// The checksums are right after the table
+				if checkAlgo != ClusterCheckNone {
+					if _, err := allocate(); err != nil {
+						return err
+					}
+				}
+			}
+			at, err := allocate()
+			if err != nil {
+				return err
+			}
+			l2[j] = at
+			if _, err := options.File.WriteAt(data, clustersStart+at<<clusterExp); err != nil {
+				return err
+			}
+			if checkAlgo != ClusterCheckNone {
+				sum, _ := computeClusterChecksum(data, checkAlgo)
+				sums[j] = int64(sum)
+			}
+		}
+
+		if l1[i] >= 0 {
+			if err := writeIndices(options.File, l2, indexSize, clustersStart+l1[i]<<clusterExp); err != nil {
+				return err
+			}
+			if checkAlgo != ClusterCheckNone {
+				if err := writeIndices(options.File, sums, 4, clustersStart+(l1[i]+1)<<clusterExp); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := writeIndices(options.File, l1, indexSize, start); err != nil {
+		return err
+	}
+
+	// Write the ending
+
+	end := clustersStart + nextCluster<<clusterExp
+	if end+endingBytes > areaEnd {
+		return ErrArchiveFull
+	}
+	ending := []entries.Entry{
+		entries.Ending{},
+		entries.ImageKey{},
+	}
+	// Readers without WideClusters see an empty image, not a wrong
+	// one
+	endingCount := uint32(dataClusterCount)
+	if wide {
+		ending = append(ending, entries.WideClusters{DataClusterCount: uint64(dataClusterCount)})
+		endingCount = 0
+	}
+	// Left out when the newest ending is of the header's size, like
+	// those written here
+	if prevBlocks != 0 {
+		ending = append(ending, entries.PrevEndingSize{Size: prevBlocks})
+	}
+	ending[0] = entries.Ending{
+		Length:           uint32(sizeOfHeader(ending)),
+		Start:            uint32(start >> blockExp),
+		Prev:             uint32(endAt >> blockExp),
+		DataClusterCount: endingCount,
+		ClusterSizeExp:   header.ImageBasic.ImgClusterSizeExp,
+		ClustersOffset:   uint32(clustersOffset),
+	}
+	var buf bytes.Buffer
+	if err := writeImageEnding(&buf, ending, header.EndingCipher.Algo, publicKey,
+		uint(header.EndingSize.Size), blockSize); err != nil {
+		return err
+	}
+	if _, err := options.File.WriteAt(buf.Bytes(), end); err != nil {
+		return err
+	}
+	if err := options.File.Sync(); err != nil {
+		return err
+	}
+
+	// Point to the new ending
+
+	endPointer := makeEndPointer(uint32((end+endingBytes)>>blockExp), 0,
+		header.EndPointerChec.Algo, blockSize, binary.LittleEndian)
+	for _, e := range header.EndPointerLoca {
+		if _, err := options.File.WriteAt(endPointer, int64(e.Blk)<<blockExp); err != nil {
+			return &EndPointerError{e.Blk, err}
+		}
+		if err := options.File.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeIndices writes a cluster table of size byte entries at pos.
+func writeIndices(w io.WriterAt, table []int64, size int, pos int64) error {
+	data := make([]byte, size*len(table))
+	for i, v := range table {
+		if size == 8 {
+			binary.LittleEndian.PutUint64(data[8*i:], uint64(v))
+		} else {
+			binary.LittleEndian.PutUint32(data[4*i:], uint32(v))
+		}
+	}
+	_, err := w.WriteAt(data, pos)
+	return err
+}
@@ -0,0 +1,285 @@
+package archive
+
+import (
+	"./entries"
+	"crypto/aes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/xts"
+)
+
+// Archive is an archive opened for reading images in place, without
+// extracting them.
+type Archive struct {
+	options *ExtractOptions
+	Header  entries.ArchiveHeaderRead
+	images  []archiveImage
+}
+
+type archiveImage struct {
+	// Start of the ending, in bytes
+	end    int64
+	ending entries.EndingRead
+}
+
+// OpenArchive reads the header and the endings of all images.  Images
+// are indexed as by ExtractArchive, newest first.  options.File must
+// stay open while the archive is used.  Close closes it.
+func OpenArchive(options *ExtractOptions) (*Archive, error) {
+	a := &Archive{options: options}
+	if err := readArchiveHeader(options, &a.Header); err != nil {
+		return nil, err
+	}
+
+	err := walkImages(options, &a.Header, func(index int, endAt int64, ending *entries.EndingRead) (bool, error) {
+		a.images = append(a.images, archiveImage{endAt - endingBytes(&a.Header, ending), *ending})
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Close closes the archive file.  The archive can't be used after.
+func (a *Archive) Close() error {
+	return a.options.Close()
+}
+
+// ImageCount returns the number of images in the archive.
+func (a *Archive) ImageCount() int {
+	return len(a.images)
+}
+
+// ImageReaderAt returns a reader of the contents of an image, as seen by
+// a virtual machine using the extracted QCOW2, and its size in bytes.
+// Unallocated clusters read as zeros.  The reader can be used
+// concurrently.
+//
+// Images encrypted with XTS-AES are decrypted with the key in their
+// ending.  Compressed images give ErrImageCompressed.
+func (a *Archive) ImageReaderAt(index int) (io.ReaderAt, int64, error) {
+	if index < 0 || index >= len(a.images) {
+		return nil, 0, fmt.Errorf("No image %d, archive has %d", index, len(a.images))
+	}
+	img := &a.images[index]
+	endAt := img.end + endingBytes(&a.Header, &img.ending)
+	if a.Header.ImgCompression.Algo != ImgCompressionNone {
+		return nil, 0, &ImageError{index, endAt, ErrImageCompressed}
+	}
+	r, err := newImageReader(a.options.File, img.end, &img.ending, &a.Header, byteOrder(&a.Header))
+	if err != nil {
+		return nil, 0, &ImageError{index, endAt, err}
+	}
+
+	switch a.Header.ImageBasic.ImgCipher {
+	case ImgCipherNull:
+		break
+	case ImgCipherXTSAES:
+		key := img.ending.ImageKey.Key
+		if len(key) != imgKeySize(ImgCipherXTSAES) {
+			return nil, 0, &ImageError{index, endAt, fmt.Errorf("%w, %d bytes", ErrBadImageKey, len(key))}
+		}
+		if r.cipher, err = xts.NewCipher(aes.NewCipher, key); err != nil {
+			return nil, 0, &ImageError{index, endAt, fmt.Errorf("%w, %v", ErrBadImageKey, err)}
+		}
+	default:
+		return nil, 0, &ImageError{index, endAt, unknownEnum{"ImgCipher", a.Header.ImageBasic.ImgCipher}}
+	}
+	return r, r.size, nil
+}
+
+// ImageAllocationMap returns which clusters of an image are allocated,
+// indexed by cluster of the image as seen by a virtual machine.
+// Clusters not allocated read as zeros.  The cluster tables aren't
+// encrypted, so this works for encrypted images too.
+func (a *Archive) ImageAllocationMap(index int) ([]bool, error) {
+	if index < 0 || index >= len(a.images) {
+		return nil, fmt.Errorf("No image %d, archive has %d", index, len(a.images))
+	}
+	img := &a.images[index]
+	endAt := img.end + endingBytes(&a.Header, &img.ending)
+	r, err := newImageReader(a.options.File, img.end, &img.ending, &a.Header, byteOrder(&a.Header))
+	if err != nil {
+		return nil, &ImageError{index, endAt, err}
+	}
+
+	result := make([]bool, r.geometry.dataClusterCount)
+	indexSize := 1 << r.geometry.indexExp
+	perL2 := 1 << (r.clusterExp - r.geometry.indexExp)
+	table := make([]byte, 1<<r.clusterExp)
+	for i, l2 := range r.l1 {
+		if l2 < 0 {
+			continue
+		}
+		// Each table is read once, unlike by dataCluster
+		if err := readFullAt(r.src, table, r.clustersStart+l2<<r.clusterExp); err != nil {
+			return nil, &ImageError{index, endAt, err}
+		}
+		for j := 0; j < perL2 && i*perL2+j < len(result); j++ {
+			v := r.geometry.clusterIndex(table[indexSize*j:], r.order)
+			result[i*perL2+j] = r.clusterIndex(v) >= 0
+		}
+	}
+
+	return result, nil
+}
+
+// imageReader reads an image through its cluster tables.  It has no
+// state that changes, so it can be used concurrently.
+type imageReader struct {
+	src               io.ReaderAt
+	clustersStart     int64
+	clusterExp        uint8
+	allocatedClusters int64
+	l1                []int64
+	size              int64
+	order             binary.ByteOrder
+	geometry          *imageGeometry
+	// Decrypts data clusters, nil if they aren't encrypted
+	cipher *xts.Cipher
+}
+
+func newImageReader(src io.ReaderAt, end int64, ending *entries.EndingRead, header *entries.ArchiveHeaderRead, order binary.ByteOrder) (*imageReader, error) {
+	geometry, err := getImageGeometry(end, ending, header)
+	if err != nil {
+		return nil, err
+	}
+	clustersStart := geometry.clustersStart
+
+	r := &imageReader{
+		src:               src,
+		clustersStart:     clustersStart,
+		clusterExp:        geometry.clusterExp,
+		allocatedClusters: (end - clustersStart) >> geometry.clusterExp,
+		l1:                make([]int64, geometry.l1Len),
+		size:              geometry.size(),
+		order:             order,
+		geometry:          geometry,
+	}
+
+	indexSize := 1 << geometry.indexExp
+	data := make([]byte, indexSize*len(r.l1))
+	if err := readFullAt(src, data, geometry.start); err != nil {
+		return nil, err
+	}
+	for i := range r.l1 {
+		r.l1[i] = r.clusterIndex(geometry.clusterIndex(data[indexSize*i:], order))
+	}
+
+	return r, nil
+}
+
+// clusterIndex checks an index read from a cluster table.  Bad ones
+// are taken as unallocated, like extractImage does.
+func (r *imageReader) clusterIndex(v int64) int64 {
+	if v < 0 || v >= r.allocatedClusters {
+		return -1
+	}
+	return v
+}
+
+// dataCluster returns the byte position of data cluster n of the image,
+// or -1 if it isn't allocated.
+func (r *imageReader) dataCluster(n int64) (int64, error) {
+	perL2Exp := r.clusterExp - r.geometry.indexExp
+	l2 := r.l1[n>>perL2Exp]
+	if l2 < 0 {
+		return -1, nil
+	}
+
+	var data [8]byte
+	index := data[:1<<r.geometry.indexExp]
+	at := r.clustersStart + l2<<r.clusterExp + int64(len(index))*(n&(1<<perL2Exp-1))
+	if err := readFullAt(r.src, index, at); err != nil {
+		return 0, err
+	}
+	cluster := r.clusterIndex(r.geometry.clusterIndex(index, r.order))
+	if cluster < 0 {
+		return -1, nil
+	}
+	return r.clustersStart + cluster<<r.clusterExp, nil
+}
+
+func (r *imageReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+
+	n := 0
+	clusterSize := int64(1) << r.clusterExp
+	for len(p) != 0 {
+		if off >= r.size {
+			return n, io.EOF
+		}
+
+		// Read up to the end of the cluster
+		inCluster := off & (clusterSize - 1)
+		chunk := clusterSize - inCluster
+		if chunk > int64(len(p)) {
+			chunk = int64(len(p))
+		}
+		if chunk > r.size-off {
+			chunk = r.size - off
+		}
+
+		at, err := r.dataCluster(off >> r.clusterExp)
+		if err != nil {
+			return n, err
+		}
+		if at < 0 {
+			for i := range p[:chunk] {
+				p[i] = 0
+			}
+		} else if r.cipher != nil {
+			if err := r.readDecrypted(p[:chunk], at, off); err != nil {
+				return n, err
+			}
+		} else if err := readFullAt(r.src, p[:chunk], at+inCluster); err != nil {
+			return n, err
+		}
+
+		n += int(chunk)
+		p = p[chunk:]
+		off += chunk
+	}
+
+	return n, nil
+}
+
+// readDecrypted reads p from off in the image, within the data cluster
+// at at.  The whole sectors p is in are read to be decrypted.
+func (r *imageReader) readDecrypted(p []byte, at, off int64) error {
+	inCluster := off & (1<<r.clusterExp - 1)
+	first := alignDown(inCluster, xtsSectorSize)
+	last := alignUp(inCluster+int64(len(p)), xtsSectorSize)
+	data := make([]byte, last-first)
+	if err := readFullAt(r.src, data, at+first); err != nil {
+		return err
+	}
+
+	sector := uint64(off-inCluster+first) / xtsSectorSize
+	for i := 0; i < len(data); i += xtsSectorSize {
+		r.cipher.Decrypt(data[i:i+xtsSectorSize], data[i:i+xtsSectorSize], sector)
+		sector++
+	}
+	copy(p, data[inCluster-first:])
+	return nil
+}
+
+// readFullAt reads exactly len(p) bytes.  A full read may come with
+// io.EOF at the end of input, which is fine.  Not every reader reports
+// a short read as an error, so n is checked instead of err.
+func readFullAt(r io.ReaderAt, p []byte, off int64) error {
+	if n, err := r.ReadAt(p, off); n != len(p) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
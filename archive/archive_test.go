@@ -0,0 +1,70 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/aes"
+	"testing"
+
+	"golang.org/x/crypto/xts"
+)
+
+func TestImageReaderAtXTS(t *testing.T) {
+	f, _ := testArchive(t, 1)
+	a, err := OpenArchive(&ExtractOptions{File: f})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, size, err := a.ImageReaderAt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make([]byte, size)
+	if err := readFullAt(plain, want, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Encrypt the data clusters in place, as a device would have
+	// written them
+	key := bytes.Repeat([]byte{1, 2, 3, 4}, 16)
+	c, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := plain.(*imageReader)
+	clusterSize := int64(1) << r.clusterExp
+	for n := int64(0); n*clusterSize < size; n++ {
+		at, err := r.dataCluster(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if at < 0 {
+			continue
+		}
+		data := make([]byte, clusterSize)
+		if err := readFullAt(f, data, at); err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < clusterSize; i += xtsSectorSize {
+			c.Encrypt(data[i:i+xtsSectorSize], data[i:i+xtsSectorSize], uint64((n*clusterSize+i)/xtsSectorSize))
+		}
+		if _, err := f.WriteAt(data, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Header.ImageBasic.ImgCipher = ImgCipherXTSAES
+	a.images[0].ending.ImageKey.Key = key
+
+	decrypted, _, err := a.ImageReaderAt(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, span := range [][2]int64{{0, size}, {1000, 3500}, {511, 2}, {size - 3, 3}} {
+		got := make([]byte, span[1])
+		if err := readFullAt(decrypted, got, span[0]); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want[span[0]:span[0]+span[1]]) {
+			t.Errorf("%d bytes at %d differ", span[1], span[0])
+		}
+	}
+}
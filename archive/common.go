@@ -3,21 +3,110 @@ package archive
 import (
 	"./entries"
 	"bufio"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
 )
 
+// BlockSize is the default block size.  An archive can have bigger
+// blocks, given in its header.
 const BlockSize = 512
 
+// Blocks are at most 64KiB
+const maxBlockSizeExp = 7
+
+// Where the package logs.  Warnings about anomalies in archives go to
+// Warn, notes on progress to Info, and details for diagnosing a broken
+// archive, like each ending followed, to Debug.  Any can be set to a
+// logger writing to ioutil.Discard to silence it.
+var (
+	Warn  = log.Default()
+	Info  = log.New(ioutil.Discard, "", 0)
+	Debug = log.New(ioutil.Discard, "", 0)
+)
+
+// Threads limits how many goroutines work at once wherever work is
+// spread over them.  Set it before using the package.
+var Threads = runtime.NumCPU()
+
+// threads returns Threads, at least 1.
+func threads() int {
+	if Threads < 1 {
+		return 1
+	}
+	return Threads
+}
+
+// detectByteOrder tells the byte order of an archive from the size of
+// its first entry.  The entry is small, so its size read in the wrong
+// order is huge.
+func detectByteOrder(size []byte) binary.ByteOrder {
+	if binary.LittleEndian.Uint32(size) > binary.BigEndian.Uint32(size) {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// byteOrder returns the byte order of the archive of header, or
+// little-endian if it isn't known.
+func byteOrder(header *entries.ArchiveHeaderRead) binary.ByteOrder {
+	if header.ByteOrder == nil {
+		return binary.LittleEndian
+	}
+	return header.ByteOrder
+}
+
+// HeaderBlockSize returns the block size of an archive in bytes.
+func HeaderBlockSize(header *entries.ArchiveHeaderRead) int64 {
+	return int64(1) << blockSizeExp(header)
+}
+
+// blockSizeExp returns log2 of the block size of an archive.
+func blockSizeExp(header *entries.ArchiveHeaderRead) uint8 {
+	return 9 + header.BlockSize.SizeExp
+}
+
 const (
-	ImgCipherNull   = 0
+	ImgCipherNull = 0
+	// AES-256-XTS with the key in the ending's ImageKey.  Each 512
+	// byte sector of data clusters is encrypted on its own, with the
+	// sector number in the image as seen by a virtual machine as the
+	// tweak, little-endian, like plain64 of dm-crypt.
 	ImgCipherXTSAES = 1
 )
 
+// Size in bytes of what each tweak of the image cipher covers
+const xtsSectorSize = 512
+
+// imgKeySize returns the size of the key stored in ImageKey.
+func imgKeySize(cipher uint32) int {
+	switch cipher {
+	case ImgCipherNull:
+		return 0
+	case ImgCipherXTSAES:
+		// AES-256-XTS
+		return 64
+	default:
+		panic(fmt.Sprintf("unrecognized image cipher %d", cipher))
+	}
+}
+
+const (
+	ImgCompressionNone = 0
+	ImgCompressionZlib = 1
+	ImgCompressionZstd = 2
+)
+
 const (
 	EndingCipherNull = 0
 	EndingCipherRSA  = 1
@@ -28,8 +117,63 @@ const (
 	EndPointerChecksumCRC32  = 1
 )
 
+const (
+	HeaderChecksumSHA256 = 0
+	HeaderChecksumCRC32C = 1
+)
+
+const (
+	ClusterCheckNone  = 0
+	ClusterCheckCRC32 = 1
+)
+
 var crc32cTable *crc32.Table = crc32.MakeTable(crc32.Castagnoli)
 
+// EndPointerChecksumAlgo is an algorithm for end pointer checksums.
+type EndPointerChecksumAlgo struct {
+	// Name used on the command line
+	Name string
+	// Length of the digest in bytes, at most 32.  The rest of the
+	// checksum field is zeros.
+	DigestLen int
+	Compute   func(data []byte) []byte
+}
+
+// EndPointerChecksums has the end pointer checksum algorithms by the
+// value of EndPointerChec.Algo.  Everything that needs the set of
+// algorithms uses it, so an algorithm is added by registering it.
+var EndPointerChecksums = map[uint32]EndPointerChecksumAlgo{
+	EndPointerChecksumSHA256: {
+		Name:      "sha256",
+		DigestLen: sha256.Size,
+		Compute: func(data []byte) []byte {
+			sum := sha256.Sum256(data)
+			return sum[:]
+		},
+	},
+	EndPointerChecksumCRC32: {
+		Name:      "crc32",
+		DigestLen: 4,
+		Compute: func(data []byte) []byte {
+			sum := make([]byte, 4)
+			binary.LittleEndian.PutUint32(sum, crc32.Checksum(data, crc32cTable))
+			return sum
+		},
+	},
+}
+
+// RegisterEndPointerChecksum adds an end pointer checksum algorithm.
+// It panics if id is taken or the digest doesn't fit.
+func RegisterEndPointerChecksum(id uint32, algo EndPointerChecksumAlgo) {
+	if _, ok := EndPointerChecksums[id]; ok {
+		panic(fmt.Sprintf("end pointer checksum %d registered twice", id))
+	}
+	if algo.DigestLen > 32 {
+		panic(fmt.Sprintf("end pointer checksum %s too long, %d bytes", algo.Name, algo.DigestLen))
+	}
+	EndPointerChecksums[id] = algo
+}
+
 func gotBadType(t reflect.Type) {
 	panic(fmt.Sprintf("bad type %s.%s", t.PkgPath(), t.Name()))
 }
@@ -51,6 +195,9 @@ func forEachField(v reflect.Value, cb func(reflect.Value) error) error {
 	}
 
 	for i := 0; i < limit; i++ {
+		if v.Kind() == reflect.Struct && v.Type().Field(i).Tag.Get("entry") == "-" {
+			continue
+		}
 		v := getter(v, i)
 		if v.Kind() == reflect.Interface {
 			v = v.Elem()
@@ -63,19 +210,45 @@ func forEachField(v reflect.Value, cb func(reflect.Value) error) error {
 	return nil
 }
 
-func computeEndPointerChecksum(data []byte, algo uint32) []byte {
+// computeEndPointerChecksum puts the checksum of the end pointer block
+// data into sum, which must be 32 bytes, and returns it.  The checksum
+// field of data is overwritten.  sum may be the checksum field itself.
+func computeEndPointerChecksum(data []byte, algo uint32, sum []byte) []byte {
 	copy(data[:32], []byte("END-POINTER\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+	checksumAlgo, ok := EndPointerChecksums[algo]
+	if !ok {
+		panic(fmt.Sprintf("unrecognized checksum type %d", algo))
+	}
+	checksum := checksumAlgo.Compute(data)
+	for i := range sum {
+		sum[i] = 0
+	}
+	copy(sum, checksum[:checksumAlgo.DigestLen])
+	return sum
+}
+
+// computeHeaderChecksum returns the checksum of the header data.  The
+// checksum field of data must be zeros.
+func computeHeaderChecksum(data []byte, algo uint32) (sum [32]byte, err error) {
 	switch algo {
-	case EndPointerChecksumSHA256:
-		checksum := sha256.Sum256(data)
-		return checksum[:]
-	case EndPointerChecksumCRC32:
-		result := make([]byte, 32)
-		binary.LittleEndian.PutUint32(result[:4],
-			crc32.Checksum(data, crc32cTable))
-		return result
+	case HeaderChecksumSHA256:
+		sum = sha256.Sum256(data)
+	case HeaderChecksumCRC32C:
+		binary.LittleEndian.PutUint32(sum[:4], crc32.Checksum(data, crc32cTable))
 	default:
-		panic(fmt.Sprintf("unrecognized checksum type %d", algo))
+		err = unknownEnum{"HeaderChecksum.Algo", algo}
+	}
+	return
+}
+
+// computeClusterChecksum returns the checksum of a data cluster as
+// stored, for the table after its L2 table.
+func computeClusterChecksum(data []byte, algo uint32) (uint32, error) {
+	switch algo {
+	case ClusterCheckCRC32:
+		return crc32.Checksum(data, crc32cTable), nil
+	default:
+		return 0, unknownEnum{"ClusterCheck.Algo", algo}
 	}
 }
 
@@ -93,8 +266,79 @@ const (
 	FillSeek = iota
 	FillZero
 	FillRandom
+	// Discard whole blocks on block devices, and write zeros
+	// elsewhere
+	FillDiscard
+	// Repeat NewArchiveOptions.FillPattern, so unused space can be
+	// told from zeros
+	FillPattern
 )
 
+func isBlockDevice(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	mode := info.Mode()
+	return mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0
+}
+
+// isZero tells whether p is all zeros.  Every cluster of an image is
+// checked, so it compares 32 bytes at a time.
+func isZero(p []byte) bool {
+	for len(p) >= 32 {
+		if binary.LittleEndian.Uint64(p)|
+			binary.LittleEndian.Uint64(p[8:])|
+			binary.LittleEndian.Uint64(p[16:])|
+			binary.LittleEndian.Uint64(p[24:]) != 0 {
+			return false
+		}
+		p = p[32:]
+	}
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// syncOutput flushes f to stable storage.  If created, its directory
+// is too, so its name is kept.
+func syncOutput(f *os.File, created bool) error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if !created {
+		return nil
+	}
+	dir, err := os.Open(filepath.Dir(f.Name()))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// ctxWriteSeeker fails writes once ctx is done, so long runs of writes
+// can be interrupted.
+type ctxWriteSeeker struct {
+	io.WriteSeeker
+	ctx context.Context
+}
+
+func (w ctxWriteSeeker) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.WriteSeeker.Write(p)
+}
+
+// isContextErr tells whether err is from a context being done.
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
 type bufWriteSeeker struct {
 	*bufio.Writer
 	base io.Seeker
@@ -125,17 +369,27 @@ func (r *accountingBufReader) Read(p []byte) (n int, err error) {
 	return
 }
 
-func newAccountingBufReader(r io.Reader, start int64) *accountingBufReader {
+func newAccountingBufReader(r io.Reader, start int64, size int) *accountingBufReader {
 	return &accountingBufReader{
-		reader: bufio.NewReader(r),
+		reader: bufio.NewReaderSize(r, size),
 		pos:    start,
 	}
 }
 
+// reset makes r read from src at start, keeping its buffer.
+func (r *accountingBufReader) reset(src io.Reader, start int64) {
+	r.reader.Reset(src)
+	r.pos = start
+}
+
 type fillSeeker struct {
 	target io.WriteSeeker
 	pos    int64
 	method int
+	// Used by FillDiscard.  Zeros are written if nil.
+	discard func(start, length int64) error
+	// Used by FillPattern
+	pattern []byte
 }
 
 func (w *fillSeeker) Write(p []byte) (int, error) {
@@ -184,6 +438,10 @@ func (w *fillSeeker) Seek(offset int64, whence int) (int64, error) {
 		n, err = writeZeros(w.target, offset)
 	case FillRandom:
 		n, err = writeRandom(w.target, offset)
+	case FillDiscard:
+		n, err = w.fillDiscard(offset)
+	case FillPattern:
+		n, err = writePattern(w.target, w.pattern, w.pos, offset)
 	default:
 		panic(fmt.Sprintf("unknown fill method %d", w.method))
 	}
@@ -193,6 +451,57 @@ func (w *fillSeeker) Seek(offset int64, whence int) (int64, error) {
 	return w.pos, err
 }
 
+// skipTo moves to pos without filling what is skipped.
+func (w *fillSeeker) skipTo(pos int64) error {
+	if _, err := w.target.Seek(pos, io.SeekStart); err != nil {
+		return err
+	}
+	w.pos = pos
+	return nil
+}
+
+func (w *fillSeeker) fillDiscard(size int64) (int64, error) {
+	// Only whole blocks can be discarded
+	start := alignUp(w.pos, BlockSize)
+	end := alignDown(w.pos+size, BlockSize)
+	if w.discard == nil || end <= start {
+		return writeZeros(w.target, size)
+	}
+
+	n, err := writeZeros(w.target, start-w.pos)
+	if err != nil {
+		return n, err
+	}
+	// Flush
+	if _, err := w.target.Seek(0, io.SeekCurrent); err != nil {
+		return n, err
+	}
+	if err := w.discard(start, end-start); err != nil {
+		Warn.Println("Discard failed, writing zeros instead", err)
+		w.discard = nil
+		n1, err := writeZeros(w.target, size-n)
+		return n + n1, err
+	}
+	if _, err := w.target.Seek(end-start, io.SeekCurrent); err != nil {
+		return n, err
+	}
+	n += end - start
+
+	n1, err := writeZeros(w.target, size-n)
+	return n + n1, err
+}
+
+type countingWriteSeeker struct {
+	io.WriteSeeker
+	cnt int64
+}
+
+func (w *countingWriteSeeker) Write(p []byte) (int, error) {
+	n, err := w.WriteSeeker.Write(p)
+	w.cnt += int64(n)
+	return n, err
+}
+
 type sizeWriter struct {
 	cnt int
 }
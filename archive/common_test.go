@@ -0,0 +1,93 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// isZeroBytes is the plain loop isZero replaces
+func isZeroBytes(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestIsZero(t *testing.T) {
+	for _, size := range []int{0, 1, 31, 32, 33, 4096} {
+		p := make([]byte, size)
+		if !isZero(p) {
+			t.Errorf("%d zeros not zero", size)
+		}
+		for i := range p {
+			p[i] = 1
+			if isZero(p) {
+				t.Errorf("%d bytes with byte %d set taken as zero", size, i)
+			}
+			p[i] = 0
+		}
+	}
+}
+
+func BenchmarkIsZero(b *testing.B) {
+	// A cluster of 64KiB, all zeros so it is all checked
+	p := make([]byte, 64<<10)
+	for _, f := range []struct {
+		name string
+		f    func([]byte) bool
+	}{
+		{"words", isZero},
+		{"bytes", isZeroBytes},
+	} {
+		b.Run(f.name, func(b *testing.B) {
+			b.SetBytes(int64(len(p)))
+			for i := 0; i < b.N; i++ {
+				if !f.f(p) {
+					b.Fatal("Not zero")
+				}
+			}
+		})
+	}
+}
+
+// Reading the L2 tables of an image, with a reader for each as before,
+// or one reader reset for each as extractImage does
+func BenchmarkL2Reader(b *testing.B) {
+	const tableSize = 4096
+	const tables = 64
+	src := bytes.NewReader(make([]byte, tables*tableSize))
+	index := make([]byte, 4)
+	readTable := func(b *testing.B, r *accountingBufReader) {
+		for i := 0; i < tableSize/len(index); i++ {
+			if _, err := io.ReadFull(r, index); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for n := int64(0); n < tables; n++ {
+				src.Seek(n*tableSize, io.SeekStart)
+				readTable(b, newAccountingBufReader(io.LimitReader(src, tableSize), n*tableSize, 4096))
+			}
+		}
+	})
+	b.Run("reset", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			table := &io.LimitedReader{R: src}
+			r := newAccountingBufReader(table, 0, 4096)
+			for n := int64(0); n < tables; n++ {
+				src.Seek(n*tableSize, io.SeekStart)
+				table.N = tableSize
+				r.reset(table, n*tableSize)
+				readTable(b, r)
+			}
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionNone = 0
+	CompressionGzip = 1
+	CompressionZstd = 2
+)
+
+// compressionExtension returns what is appended to the names of
+// outputs compressed this way.
+func compressionExtension(compression uint32) string {
+	switch compression {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// compressOutput wraps f so what is written to it is compressed.  close
+// must be called after the last write to finish the stream.  f itself
+// is returned if compression is CompressionNone.
+func compressOutput(f io.WriteSeeker, compression uint32) (w io.WriteSeeker, close func() error, err error) {
+	switch compression {
+	case CompressionNone:
+		return f, func() error { return nil }, nil
+	case CompressionGzip:
+		zw := gzip.NewWriter(f)
+		return &forwardSeeker{w: zw}, zw.Close, nil
+	case CompressionZstd:
+		zw, err := zstd.NewWriter(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &forwardSeeker{w: zw}, zw.Close, nil
+	default:
+		return nil, nil, unknownEnum{"Compression", compression}
+	}
+}
+
+// forwardSeeker makes a stream seekable forward, by writing zeros over
+// what is skipped.  It is enough for writing QCOW2, whose parts are
+// written in order.
+type forwardSeeker struct {
+	w   io.Writer
+	pos int64
+}
+
+func (w *forwardSeeker) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.pos += int64(n)
+	return n, err
+}
+
+func (w *forwardSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += w.pos
+	default:
+		return w.pos, errors.New("Can only seek from the start or the current position of a stream")
+	}
+	if offset < w.pos {
+		return w.pos, errors.New("Can't seek backwards in a stream")
+	}
+
+	_, err := writeZeros(w, offset-w.pos)
+	return w.pos, err
+}
+
+// clusterDecompressor expands the data clusters of images with
+// ImgCompression.  Each allocated data cluster holds a stream of its
+// contents, padded to the cluster size.  Cluster tables aren't
+// compressed.
+type clusterDecompressor struct {
+	algo uint32
+	out  []byte
+	zstd *zstd.Decoder
+}
+
+func newClusterDecompressor(algo uint32, clusterExp uint8) (*clusterDecompressor, error) {
+	d := &clusterDecompressor{
+		algo: algo,
+		out:  make([]byte, 1<<clusterExp),
+	}
+	switch algo {
+	case ImgCompressionZlib:
+	case ImgCompressionZstd:
+		var err error
+		if d.zstd, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, unknownEnum{"ImgCompression.Algo", algo}
+	}
+	return d, nil
+}
+
+// expand decompresses a cluster as stored.  The stream must give a
+// whole cluster.  The result is overwritten by the next call.
+func (d *clusterDecompressor) expand(in []byte) ([]byte, error) {
+	var r io.Reader
+	switch d.algo {
+	case ImgCompressionZlib:
+		zr, err := zlib.NewReader(bytes.NewReader(in))
+		if err != nil {
+			return nil, fmt.Errorf("Bad compressed cluster %v", err)
+		}
+		r = zr
+	case ImgCompressionZstd:
+		if err := d.zstd.Reset(bytes.NewReader(in)); err != nil {
+			return nil, err
+		}
+		r = d.zstd
+	}
+	if _, err := io.ReadFull(r, d.out); err != nil {
+		return nil, fmt.Errorf("Bad compressed cluster %v", err)
+	}
+	return d.out, nil
+}
+
+func (d *clusterDecompressor) close() {
+	if d.zstd != nil {
+		d.zstd.Close()
+	}
+}
@@ -3,6 +3,7 @@ package archive
 import (
 	"./entries"
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -10,10 +11,14 @@ import (
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"os"
 	"reflect"
-	"runtime"
+	"sort"
+	"sync"
 )
 
 type LogConf struct {
@@ -29,85 +34,250 @@ type NewArchiveOptions struct {
 	EndPointersTail    uint
 	EndingCipher       uint32
 	EndPointerChecksum uint32
+	HeaderChecksum     uint32
 	PublicKeyRSA       *rsa.PublicKey
 	ImgCipher          uint32
-	ImgClusterSizeExp  uint8
+	ImgClusterSizeExp  uint8 // relative to the block size
 	AlignmentBlocks    int64
+	BlockSize          int64 // in bytes, 0 for BlockSize
 	FillMethod         uint32
+	// Repeated to fill with FillPattern
+	FillPattern []byte
+	// Written at the end of the header.  Each is of a registered
+	// type, or a RawEntry.
+	Optional []entries.Entry
+	// Compute and check the layout without writing anything.
+	// Output is only read for its size if it is a block device, and
+	// may be nil.
+	DryRun bool
+	// Continue an interrupted run on the same Output with the same
+	// options.  The header and the end pointers before the image
+	// area are kept, and filling starts at ResumeFrom, in bytes.
+	// Output must be an io.ReaderAt.
+	Resume     bool
+	ResumeFrom int64
+	// If not nil, Output must be an SD card with this CID, so the
+	// wrong card isn't overwritten
+	ExpectSdCid *[15]byte
+	// If not nil, the CID recorded in the header, so extracting can
+	// check it is written to that card
+	SdCid *[15]byte
+	// Record the CID of Output, which must be an SD card, instead
+	RecordSdCid bool
+	// Put a checksum of each global log in the header, with the
+	// header checksum algorithm, for ReadGlobalLogs to check
+	GlobalLogChecksums bool
+	// Endings are made at least this many blocks, so entries can be
+	// added to them later without moving them.  Readers ignore the
+	// padding.
+	MinEndingBlocks uint32
+	// If not nil, end pointers are put at these blocks instead, and
+	// EndPointersHead and EndPointersTail aren't used.  The image
+	// area is then the longest stretch between them.  Each must be
+	// past the header and global logs, in its own allocation unit.
+	EndPointerBlocks []uint32
+	// How the device compresses data clusters.  Recorded for
+	// extracting to expand them.
+	ImgCompression uint32
+	// Follow each L2 table with checksums of its data clusters, for
+	// ExtractOptions.VerifyClusters to check
+	ClusterChecksums bool
 }
 
-func alignWriter(w io.WriteSeeker, alignment int64) error {
-	cur, err := w.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return err
+var randReader *io.PipeReader
+var randQuit chan struct{}
+var randWorkers sync.WaitGroup
+
+// RandReaderConf configures the random fill source.
+type RandReaderConf struct {
+	// If not nil, the fill data is derived from Seed instead of
+	// crypto/rand, so it is the same every run, whatever Workers
+	// and BufferSize are.  For testing only.
+	Seed []byte
+	// Number of workers generating data.  Threads if 0.
+	Workers int
+	// Bytes each worker generates at a time, and holds a buffer
+	// of.  4MiB if 0.  Rounded up to a multiple of 16.
+	BufferSize int
+}
+
+func writeRandWorker(w *io.PipeWriter, start <-chan struct{}, done chan<- struct{}, quit <-chan struct{}, fill func([]byte), bufSize int) {
+	defer randWorkers.Done()
+
+	buf := make([]byte, bufSize)
+
+	for {
+		fill(buf)
+		select {
+		case <-start:
+		case <-quit:
+			return
+		}
+		if _, err := w.Write(buf); err != nil {
+			// The reader is closed
+			return
+		}
+		done <- struct{}{}
 	}
+}
 
-	_, err = w.Seek((alignment-1)&-cur, io.SeekCurrent)
-	return err
+// ctrAt returns iv advanced by n blocks, as CTR mode counts them.
+func ctrAt(iv []byte, n uint64) []byte {
+	result := make([]byte, aes.BlockSize)
+	copy(result, iv)
+	low := binary.BigEndian.Uint64(result[8:])
+	binary.BigEndian.PutUint64(result[8:], low+n)
+	if low+n < low {
+		binary.BigEndian.PutUint64(result[:8], binary.BigEndian.Uint64(result[:8])+1)
+	}
+	return result
 }
 
-var randReader *io.PipeReader
+// RandReaderInit starts the workers generating random fill data.  They
+// run until RandReaderClose is called.
+func RandReaderInit() {
+	RandReaderInitConf(&RandReaderConf{})
+}
 
-func writeRandWorker(w *io.PipeWriter, start <-chan struct{}, done chan<- struct{}) {
-	buf := make([]byte, 0x400000)
+// RandReaderInitConf is RandReaderInit with configuration.
+func RandReaderInitConf(conf *RandReaderConf) {
+	RandReaderClose()
 
-	keyIV := make([]byte, 32)
-	if _, err := rand.Read(keyIV); err != nil {
-		panic(err)
+	workers := conf.Workers
+	if workers <= 0 {
+		workers = threads()
 	}
-
-	blockCipher, err := aes.NewCipher(keyIV[0:16])
-	if err != nil {
-		panic(err)
+	bufSize := conf.BufferSize
+	if bufSize <= 0 {
+		bufSize = 0x400000
 	}
+	bufSize = (bufSize + aes.BlockSize - 1) &^ (aes.BlockSize - 1)
 
-	streamCipher := cipher.NewCTR(blockCipher, keyIV[16:32])
+	// Buffers are written in turn, so worker i makes buffers i,
+	// i+workers, and so on
+	workerFill := func(i int) func([]byte) {
+		if conf.Seed == nil {
+			keyIV := make([]byte, 32)
+			if _, err := rand.Read(keyIV); err != nil {
+				panic(err)
+			}
+			blockCipher, err := aes.NewCipher(keyIV[0:16])
+			if err != nil {
+				panic(err)
+			}
+			streamCipher := cipher.NewCTR(blockCipher, keyIV[16:32])
+			return func(buf []byte) {
+				streamCipher.XORKeyStream(buf, buf)
+			}
+		}
 
-	for {
-		streamCipher.XORKeyStream(buf, buf)
-		<-start
-		if _, err := w.Write(buf); err != nil {
+		// One stream for the whole output, each buffer taken
+		// from where it is in the output
+		keyIV := sha256.Sum256(conf.Seed)
+		blockCipher, err := aes.NewCipher(keyIV[0:16])
+		if err != nil {
 			panic(err)
 		}
-		done <- struct{}{}
+		n := uint64(i)
+		return func(buf []byte) {
+			for j := range buf {
+				buf[j] = 0
+			}
+			iv := ctrAt(keyIV[16:32], n*uint64(bufSize)/aes.BlockSize)
+			cipher.NewCTR(blockCipher, iv).XORKeyStream(buf, buf)
+			n += uint64(workers)
+		}
 	}
-}
 
-func RandReaderInit() {
 	var writer *io.PipeWriter
 	randReader, writer = io.Pipe()
+	randQuit = make(chan struct{})
 
 	chFirst := make(chan struct{}, 1)
 	chi := chFirst
 	// Start the workers
-	for i := runtime.NumCPU(); i != 0; i-- {
+	for i := 0; i < workers-1; i++ {
 		t := make(chan struct{}, 1)
-		go writeRandWorker(writer, chi, t)
+		randWorkers.Add(1)
+		go writeRandWorker(writer, chi, t, randQuit, workerFill(i), bufSize)
 		chi = t
 	}
 	// Connect the ends
-	go writeRandWorker(writer, chi, chFirst)
+	randWorkers.Add(1)
+	go writeRandWorker(writer, chi, chFirst, randQuit, workerFill(workers-1), bufSize)
 
 	// Start
 	chFirst <- struct{}{}
 }
 
+// RandReaderClose stops the workers started by RandReaderInit.  It
+// does nothing if they aren't running.
+func RandReaderClose() {
+	if randReader == nil {
+		return
+	}
+
+	close(randQuit)
+	randReader.Close()
+	randWorkers.Wait()
+	randReader = nil
+}
+
+// Never written to.  Big so filling takes few writes.
+var zeroBuf [1 << 20]byte
+
 func writeZeros(w io.Writer, size int64) (int64, error) {
-	var zeros [BlockSize]byte
 	var written int64
 
 	if size < 0 {
 		panic(fmt.Sprintf("can't write backwards size %d", size))
 	}
 
-	n, err := w.Write(zeros[:size&(BlockSize-1)])
+	// The part block first, so the rest of the writes stay aligned
+	n, err := w.Write(zeroBuf[:size&(BlockSize-1)])
 	written += int64(n)
 	if err != nil {
 		return written, err
 	}
 
-	for i := size / BlockSize; i != 0; i-- {
-		n, err := w.Write(zeros[:])
+	for written < size {
+		chunk := zeroBuf[:]
+		if rest := size - written; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		n, err := w.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// writePattern writes pattern repeated, lined up so the byte at
+// position p of the output is pattern[p%len(pattern)].  pos is the
+// position it starts at.
+func writePattern(w io.Writer, pattern []byte, pos int64, size int64) (int64, error) {
+	var written int64
+
+	if size < 0 {
+		panic(fmt.Sprintf("can't write backwards size %d", size))
+	}
+
+	// Enough to write 64KiB from any point in the pattern
+	buf := make([]byte, 0x10000+len(pattern))
+	for i := range buf {
+		buf[i] = pattern[i%len(pattern)]
+	}
+
+	for written < size {
+		phase := (pos + written) % int64(len(pattern))
+		chunk := buf[phase : phase+0x10000]
+		if rest := size - written; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		n, err := w.Write(chunk)
 		written += int64(n)
 		if err != nil {
 			return written, err
@@ -126,6 +296,22 @@ func writeRandom(w io.Writer, size int64) (int64, error) {
 }
 
 func writeEntry(w io.Writer, ent reflect.Value) error {
+	// Elements of []Entry
+	if ent.Kind() == reflect.Interface {
+		ent = ent.Elem()
+	}
+
+	if raw, ok := ent.Interface().(entries.RawEntry); ok {
+		if err := binary.Write(w, binary.LittleEndian, entries.EntryCommon{
+			EntryTypeID: raw.ID,
+			Size:        20 + uint32(len(raw.Data)),
+		}); err != nil {
+			return err
+		}
+		_, err := w.Write(raw.Data)
+		return err
+	}
+
 	// Write without the additional ID and size fields
 
 	var wbare io.Writer
@@ -197,19 +383,21 @@ func sizeOfHeader(header interface{}) int {
 	return sizer.cnt
 }
 
-func writeRepeatedly(dest io.WriteSeeker, data []byte, repeat uint, alignment int64) error {
-	for ; repeat != 0; repeat-- {
-		if _, err := dest.Write(data); err != nil {
+// writeEndPointers writes the end pointer data at each of blks, in
+// order.
+func writeEndPointers(dest io.WriteSeeker, data []byte, blks []entries.EndPointerLoca, blockSize int64) error {
+	for _, e := range blks {
+		if _, err := dest.Seek(int64(e.Blk)*blockSize, io.SeekStart); err != nil {
 			return err
 		}
-		if err := alignWriter(dest, alignment); err != nil {
+		if _, err := dest.Write(data); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func writeImageEnding(dest io.Writer, ent []entries.Entry, cipher uint32, key *rsa.PublicKey, blocks uint) error {
+func writeImageEnding(dest io.Writer, ent []entries.Entry, cipher uint32, key *rsa.PublicKey, blocks uint, blockSize int64) error {
 	var buf bytes.Buffer
 	if err := writeMultipleEntries(&buf, ent); err != nil {
 		return err
@@ -224,7 +412,7 @@ func writeImageEnding(dest io.Writer, ent []entries.Entry, cipher uint32, key *r
 		}
 	}
 
-	size := blocks * BlockSize
+	size := blocks * uint(blockSize)
 	if uint(len(data)) > size {
 		return fmt.Errorf("Image ending too long, %d, max %d", len(data), size)
 	}
@@ -243,6 +431,19 @@ func writeImageEnding(dest io.Writer, ent []entries.Entry, cipher uint32, key *r
 	return nil
 }
 
+// maxEndingPayload returns the size of the biggest ending an image
+// can have in an archive with these options.
+func maxEndingPayload(conf *NewArchiveOptions) int {
+	ending := []entries.Entry{
+		entries.Ending{},
+		entries.ImageKey{Key: make([]byte, imgKeySize(conf.ImgCipher))},
+	}
+	for range conf.ImgLogs {
+		ending = append(ending, entries.ImageLogLocati{})
+	}
+	return sizeOfHeader(ending)
+}
+
 func alignUp(n int64, alignment int64) int64 {
 	return (n + (alignment - 1)) & -alignment
 }
@@ -251,47 +452,184 @@ func alignDown(n int64, alignment int64) int64 {
 	return n & -alignment
 }
 
-func makeEndPointer(pointTo uint32, checksumType uint32) []byte {
-	data := make([]byte, 512)
+// makeEndPointer returns an end pointer to the ending ending at block
+// pointTo, of endingBlocks blocks, or of the header's size if 0.
+func makeEndPointer(pointTo uint32, endingBlocks uint32, checksumType uint32, blockSize int64, order binary.ByteOrder) []byte {
+	data := make([]byte, blockSize)
 
-	binary.LittleEndian.PutUint32(data[32:36],
+	order.PutUint32(data[32:36],
 		uint32(pointTo))
-	copy(data[:32], computeEndPointerChecksum(data, checksumType))
+	order.PutUint32(data[36:40], endingBlocks)
+	computeEndPointerChecksum(data, checksumType, data[:32])
 
 	return data
 }
 
-func WriteEmptyArchive(conf *NewArchiveOptions) error {
+// ArchiveLayout describes where WriteEmptyArchive put things.  Positions
+// and sizes are in blocks unless noted.
+type ArchiveLayout struct {
+	BlockSize    int64 // in bytes
+	HeaderSize   int64 // in bytes
+	ImgAreaStart int64
+	ImgAreaEnd   int64
+	EndingSize   uint32
+	EndPointers  []uint32
+	BytesWritten int64
+}
+
+func WriteEmptyArchive(conf *NewArchiveOptions) (*ArchiveLayout, error) {
+	return WriteEmptyArchiveContext(context.Background(), conf)
+}
+
+// WriteEmptyArchiveContext is WriteEmptyArchive, stopping with ctx's
+// error when ctx is done.  What was written is left, and can be
+// continued with Resume.
+func WriteEmptyArchiveContext(ctx context.Context, conf *NewArchiveOptions) (*ArchiveLayout, error) {
+	// Writing past the end of a device fails only when it gets there
+	if f, ok := conf.Output.(*os.File); ok && isBlockDevice(f) {
+		size, err := blockDeviceSize(f)
+		if err != nil {
+			return nil, fmt.Errorf("Querying device size: %w", err)
+		}
+		if conf.DiskSize > size {
+			return nil, fmt.Errorf("Size %d is bigger than the device, %d bytes", conf.DiskSize, size)
+		}
+	}
+
+	counter := &countingWriteSeeker{WriteSeeker: ctxWriteSeeker{conf.Output, ctx}}
+	var fileBuf *bufWriteSeeker
 	var dest *fillSeeker
 	{
-		fileBuf := newBufWriteSeeker(conf.Output)
+		fileBuf = newBufWriteSeeker(counter)
 		defer fileBuf.Flush()
 		dest = &fillSeeker{
-			target: fileBuf,
-			method: int(conf.FillMethod),
+			target:  fileBuf,
+			method:  int(conf.FillMethod),
+			pattern: conf.FillPattern,
+		}
+	}
+	if conf.FillMethod == FillPattern && len(conf.FillPattern) == 0 {
+		return nil, errors.New("Fill pattern not given")
+	}
+	if conf.FillMethod == FillDiscard && !conf.DryRun {
+		if f, ok := conf.Output.(*os.File); ok && isBlockDevice(f) {
+			dest.discard = func(start, length int64) error {
+				return discardRange(f, start, length)
+			}
+		} else {
+			Warn.Println("Output is not a block device, filling with zeros")
+		}
+	}
+
+	// The CID recorded in the header
+	var sdCid [15]byte
+	if conf.SdCid != nil {
+		sdCid = *conf.SdCid
+	}
+	if (conf.ExpectSdCid != nil || conf.RecordSdCid) && !conf.DryRun {
+		f, ok := conf.Output.(*os.File)
+		if !ok {
+			return nil, errors.New("Output isn't a device, can't read SD card CID")
+		}
+		cid, err := ReadDeviceSdCid(f)
+		if err != nil {
+			return nil, err
+		}
+		if conf.ExpectSdCid != nil {
+			if err := checkSdCid(cid, *conf.ExpectSdCid); err != nil {
+				return nil, err
+			}
+		}
+		if conf.RecordSdCid {
+			sdCid = cid
 		}
 	}
 
 	alignment := conf.AlignmentBlocks
 
+	blockSize := conf.BlockSize
+	if blockSize == 0 {
+		blockSize = BlockSize
+	}
+	var blockSizeExp uint8
+	for BlockSize<<blockSizeExp < blockSize && blockSizeExp < maxBlockSizeExp {
+		blockSizeExp++
+	}
+	if BlockSize<<blockSizeExp != blockSize {
+		return nil, fmt.Errorf("Block size %d isn't a power of 2 from %d to %d",
+			blockSize, BlockSize, BlockSize<<maxBlockSizeExp)
+	}
+
+	endPointerCount := conf.EndPointersHead + conf.EndPointersTail
+	if conf.EndPointerBlocks != nil {
+		endPointerCount = uint(len(conf.EndPointerBlocks))
+	}
+
 	// Put the correct number of each type of entries at the start,
 	// so the header's size comes out right.
 	header := entries.ArchiveHeaderWrite{
 		EndPointerChec: entries.EndPointerChec{
 			Algo: conf.EndPointerChecksum,
 		},
-		EndPointerLoca: make([]entries.EndPointerLoca,
-			conf.EndPointersHead+conf.EndPointersTail),
+		EndPointerLoca: make([]entries.EndPointerLoca, endPointerCount),
 		EndingCipher: entries.EndingCipher{
 			Algo: conf.EndingCipher,
 		},
 		GlobalLogLocat: make([]entries.GlobalLogLocat, len(conf.GlobalLogs)),
 		ImageLog:       make([]entries.ImageLog, len(conf.ImgLogs)),
+		Optional:       conf.Optional,
 		ImageBasic: entries.ImageBasic{
 			ImgCipher:         conf.ImgCipher,
 			ImgClusterSizeExp: conf.ImgClusterSizeExp,
 		},
 	}
+	for _, e := range conf.Optional {
+		if _, ok := e.(entries.RawEntry); ok {
+			continue
+		}
+		if _, ok := entries.TypeToID[reflect.TypeOf(e)]; !ok {
+			return nil, fmt.Errorf("Optional entry of type %T isn't registered", e)
+		}
+	}
+
+	if blockSizeExp != 0 {
+		header.BlockSize = []entries.BlockSize{{
+			SizeExp: blockSizeExp,
+		}}
+	}
+	if conf.ClusterChecksums {
+		header.ClusterCheck = []entries.ClusterCheck{{
+			Algo: ClusterCheckCRC32,
+		}}
+	}
+	if conf.GlobalLogChecksums {
+		header.GlobalLogCheck = make([]entries.GlobalLogCheck, len(conf.GlobalLogs))
+	}
+	switch conf.ImgCompression {
+	case ImgCompressionNone:
+	case ImgCompressionZlib, ImgCompressionZstd:
+		header.ImgCompression = []entries.ImgCompression{{
+			Algo: conf.ImgCompression,
+		}}
+	default:
+		return nil, unknownEnum{"ImgCompression", conf.ImgCompression}
+	}
+	if conf.SdCid != nil || conf.RecordSdCid {
+		header.SdCid = []entries.SdCid{{
+			SdCid: sdCid,
+		}}
+	}
+	switch conf.HeaderChecksum {
+	case HeaderChecksumSHA256:
+	case HeaderChecksumCRC32C:
+		header.HeaderChecksum = []entries.HeaderChecksum{{
+			Algo: conf.HeaderChecksum,
+		}}
+	default:
+		panic(fmt.Sprintf(
+			"WriteEmptyArchive: undefined header checksum %d",
+			conf.HeaderChecksum))
+	}
 
 	// Public key
 	var endingSize uint32
@@ -299,20 +637,41 @@ func WriteEmptyArchive(conf *NewArchiveOptions) error {
 	case EndingCipherNull:
 		endingSize = 1
 	case EndingCipherRSA:
-		endingSize = uint32(alignUp(int64(conf.PublicKeyRSA.Size()), BlockSize))
+		endingSize = uint32(alignUp(int64(conf.PublicKeyRSA.Size()), blockSize) / blockSize)
 		header.EndingCipher.Key = x509.MarshalPKCS1PublicKey(conf.PublicKeyRSA)
 	default:
 		panic(fmt.Sprintf(
 			"WriteEmptyArchive: undefined ending cipher %d",
 			conf.EndingCipher))
 	}
+	if endingSize < conf.MinEndingBlocks {
+		endingSize = conf.MinEndingBlocks
+	}
+	if endingSize > maxEndingSize {
+		return nil, fmt.Errorf("Ending too big, %d blocks, max %d", endingSize, maxEndingSize)
+	}
 	header.EndingSize.Size = endingSize
 
+	// Check the biggest ending an image could have fits, so it
+	// doesn't fail only when an image is written.
+	{
+		capacity := int(endingSize) * int(blockSize)
+		if conf.EndingCipher == EndingCipherRSA {
+			// RSA-OAEP with SHA-256
+			capacity = conf.PublicKeyRSA.Size() - 2*sha256.Size - 2
+		}
+		if size := maxEndingPayload(conf); size > capacity {
+			return nil, fmt.Errorf(
+				"Image ending can be %d bytes, but the ending cipher only fits %d",
+				size, capacity)
+		}
+	}
+
 	// Find header size
 	headerSize := sizeOfHeader(header)
 	header.CvtmMagic.HeaderLength = uint32(headerSize)
 	// imgStart is the first block of the image area.
-	imgAreaStart := alignUp(int64(headerSize), alignment*BlockSize) / BlockSize
+	imgAreaStart := alignUp(int64(headerSize), alignment*blockSize) / blockSize
 
 	// Image log
 	for i, v := range conf.ImgLogs {
@@ -327,6 +686,18 @@ func WriteEmptyArchive(conf *NewArchiveOptions) error {
 			Start: uint32(imgAreaStart),
 			Count: v.Size,
 		}
+		if conf.GlobalLogChecksums {
+			// Logs are written as zeros
+			checksum, err := computeHeaderChecksum(make([]byte, int64(v.Size)*blockSize), conf.HeaderChecksum)
+			if err != nil {
+				return nil, err
+			}
+			header.GlobalLogCheck[i] = entries.GlobalLogCheck{
+				Log:      uint32(i),
+				Algo:     conf.HeaderChecksum,
+				Checksum: checksum,
+			}
+		}
 		imgAreaStart += alignUp(int64(v.Size), alignment)
 	}
 
@@ -335,17 +706,76 @@ func WriteEmptyArchive(conf *NewArchiveOptions) error {
 	// of corruption caused by power loss when updating an end
 	// pointer.
 	endPointerStart := imgAreaStart
-	for i := uint(0); i < conf.EndPointersHead; i++ {
-		header.EndPointerLoca[i] = entries.EndPointerLoca{
-			Blk: uint32(imgAreaStart),
+	// Number of end pointers before the image area
+	headPointers := int(conf.EndPointersHead)
+	var imgAreaEnd, sentinelEnd int64
+	if conf.EndPointerBlocks != nil {
+		var err error
+		headPointers, imgAreaStart, imgAreaEnd, err = placeEndPointers(
+			header.EndPointerLoca, conf.EndPointerBlocks,
+			endPointerStart, conf.DiskSize/blockSize, alignment)
+		if err != nil {
+			return nil, err
 		}
-		imgAreaStart += alignment
-	}
-	imgAreaEnd := alignDown(conf.DiskSize/BlockSize, alignment)
-	imgAreaEnd -= alignment * int64(conf.EndPointersTail)
-	for i := uint(0); i < conf.EndPointersTail; i++ {
-		header.EndPointerLoca[conf.EndPointersHead+i] = entries.EndPointerLoca{
-			Blk: uint32(imgAreaEnd) + uint32(i)*uint32(alignment),
+		sentinelEnd = imgAreaStart + int64(header.EndingSize.Size)
+		if sentinelEnd > imgAreaEnd {
+			return nil, fmt.Errorf(
+				"No room for the image area between the end pointers, need %d blocks",
+				alignUp(int64(header.EndingSize.Size), alignment))
+		}
+		if imgAreaEnd > math.MaxUint32 {
+			return nil, fmt.Errorf(
+				"Disk too big, block %d is beyond the format's limit %d",
+				imgAreaEnd, uint32(math.MaxUint32))
+		}
+	} else {
+		for i := uint(0); i < conf.EndPointersHead; i++ {
+			header.EndPointerLoca[i] = entries.EndPointerLoca{
+				Blk: uint32(imgAreaStart),
+			}
+			imgAreaStart += alignment
+		}
+
+		// Check the disk is big enough before finding the end of the
+		// image area, so nothing comes out negative.
+		sentinelEnd = imgAreaStart + int64(header.EndingSize.Size)
+		{
+			headBlks := endPointerStart
+			headPointerBlks := imgAreaStart - endPointerStart
+			endingBlks := alignUp(sentinelEnd, alignment) - imgAreaStart
+			tailPointerBlks := alignment * int64(conf.EndPointersTail)
+			need := (headBlks + headPointerBlks + endingBlks + tailPointerBlks) * blockSize
+			if conf.DiskSize < need {
+				return nil, fmt.Errorf(
+					"Disk too small by %d bytes, size %d, need %d: header and global logs %d, head end pointers %d, ending %d, tail end pointers %d",
+					need-conf.DiskSize, conf.DiskSize, need,
+					headBlks*blockSize, headPointerBlks*blockSize,
+					endingBlks*blockSize, tailPointerBlks*blockSize)
+			}
+		}
+
+		imgAreaEnd = alignDown(conf.DiskSize/blockSize, alignment)
+		imgAreaEnd -= alignment * int64(conf.EndPointersTail)
+
+		// Block numbers are stored as uint32.  Nothing is placed after
+		// the last tail end pointer, so checking it covers every block
+		// number written.
+		{
+			lastBlk := imgAreaEnd
+			if conf.EndPointersTail != 0 {
+				lastBlk += alignment * int64(conf.EndPointersTail-1)
+			}
+			if lastBlk > math.MaxUint32 {
+				return nil, fmt.Errorf(
+					"Disk too big, block %d is beyond the format's limit %d",
+					lastBlk, uint32(math.MaxUint32))
+			}
+		}
+
+		for i := uint(0); i < conf.EndPointersTail; i++ {
+			header.EndPointerLoca[conf.EndPointersHead+i] = entries.EndPointerLoca{
+				Blk: uint32(imgAreaEnd + int64(i)*alignment),
+			}
 		}
 	}
 
@@ -354,66 +784,175 @@ func WriteEmptyArchive(conf *NewArchiveOptions) error {
 		End:   uint32(imgAreaEnd),
 	}
 
-	// Check there is enough space left for images.
-	sentinelEnd := imgAreaStart + int64(header.EndingSize.Size)
-	if sentinelEnd > imgAreaEnd {
-		return fmt.Errorf(
-			"Not enough space for images, start %d, end %d",
-			sentinelEnd, imgAreaEnd)
-	}
-
 	// Compute checksum
 	{
-		hash := sha256.New()
-		if err := writeMultipleEntries(hash, header); err != nil {
+		var buf bytes.Buffer
+		if err := writeMultipleEntries(&buf, header); err != nil {
+			panic(err)
+		}
+		checksum, err := computeHeaderChecksum(buf.Bytes(), conf.HeaderChecksum)
+		if err != nil {
 			panic(err)
 		}
-		copy(header.CvtmMagic.Checksum[:], hash.Sum(nil))
+		header.CvtmMagic.Checksum = checksum
 	}
 
-	// Write header
-	if err := writeMultipleEntries(dest, header); err != nil {
-		return err
+	layout := &ArchiveLayout{
+		BlockSize:    blockSize,
+		HeaderSize:   int64(headerSize),
+		ImgAreaStart: imgAreaStart,
+		ImgAreaEnd:   imgAreaEnd,
+		EndingSize:   endingSize,
 	}
-
-	// Write zeros until the first end pointer.  This includes the
-	// global log and any padding preceding it.
-	if _, err := writeZeros(dest, endPointerStart*BlockSize-dest.pos); err != nil {
-		return err
+	for _, e := range header.EndPointerLoca {
+		layout.EndPointers = append(layout.EndPointers, e.Blk)
+	}
+	if conf.DryRun {
+		return layout, nil
 	}
 
-	// Write the end pointers at the start
-	endPointer := makeEndPointer(uint32(sentinelEnd),
-		conf.EndPointerChecksum)
-	if err := writeRepeatedly(dest, endPointer, conf.EndPointersHead, alignment*BlockSize); err != nil {
-		return err
+	endPointer := makeEndPointer(uint32(sentinelEnd), 0,
+		conf.EndPointerChecksum, blockSize, binary.LittleEndian)
+
+	if conf.Resume {
+		if err := checkResumable(conf, header, headPointers, sentinelEnd, blockSize); err != nil {
+			return nil, err
+		}
+		if err := dest.skipTo(imgAreaStart * blockSize); err != nil {
+			return nil, err
+		}
+	} else {
+		// Write header
+		if err := writeMultipleEntries(dest, header); err != nil {
+			return nil, err
+		}
+
+		// Write zeros until the first end pointer.  This
+		// includes the global log and any padding preceding it.
+		if _, err := writeZeros(dest, endPointerStart*blockSize-dest.pos); err != nil {
+			return nil, err
+		}
+
+		// Write the end pointers at the start
+		if err := writeEndPointers(dest, endPointer, header.EndPointerLoca[:headPointers], blockSize); err != nil {
+			return nil, err
+		}
 	}
 
-	if _, err := dest.Seek(imgAreaStart*BlockSize, io.SeekStart); err != nil {
-		return err
+	if _, err := dest.Seek(imgAreaStart*blockSize, io.SeekStart); err != nil {
+		return nil, err
 	}
 
 	// Write the sentinel marking end of list of images
 	if err := writeImageEnding(dest, []entries.Entry{
 		entries.NoMoreImages{},
-	}, conf.EndingCipher, conf.PublicKeyRSA, uint(endingSize)); err != nil {
-		return err
+	}, conf.EndingCipher, conf.PublicKeyRSA, uint(endingSize), blockSize); err != nil {
+		return nil, err
 	}
 
 	// Fill the image space
-	if _, err := dest.Seek(imgAreaEnd*BlockSize, io.SeekStart); err != nil {
-		return err
+	if conf.Resume && conf.ResumeFrom > dest.pos {
+		resumeAt := alignDown(conf.ResumeFrom, blockSize)
+		if resumeAt > imgAreaEnd*blockSize {
+			resumeAt = imgAreaEnd * blockSize
+		}
+		Info.Println("Resuming fill at", resumeAt)
+		if err := dest.skipTo(resumeAt); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := dest.Seek(imgAreaEnd*blockSize, io.SeekStart); err != nil {
+		return nil, err
 	}
 
 	// Write end pointers at the end
-	if err := writeRepeatedly(dest, endPointer, conf.EndPointersTail, alignment*BlockSize); err != nil {
-		return err
+	if err := writeEndPointers(dest, endPointer, header.EndPointerLoca[headPointers:], blockSize); err != nil {
+		return nil, err
 	}
 
 	// Fill the space
 	if _, err := dest.Seek(conf.DiskSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	if err := fileBuf.Flush(); err != nil {
+		return nil, err
+	}
+
+	layout.BytesWritten = counter.cnt
+	return layout, nil
+}
+
+// placeEndPointers puts end pointers at blks, sorted, into locs.  The
+// image area is the longest run of allocation units after first with
+// no end pointer.  It returns the number of end pointers before it,
+// and where it starts and ends.
+func placeEndPointers(locs []entries.EndPointerLoca, blks []uint32, first, diskBlks, alignment int64) (head int, areaStart, areaEnd int64, err error) {
+	if len(blks) == 0 {
+		return 0, 0, 0, errors.New("No end pointer blocks given")
+	}
+	sorted := append([]uint32(nil), blks...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, blk := range sorted {
+		if int64(blk) < first || int64(blk) >= diskBlks {
+			return 0, 0, 0, fmt.Errorf("%w location %d, not from %d to %d",
+				ErrBadEndPointer, blk, first, diskBlks-1)
+		}
+		if i > 0 && int64(blk)/alignment == int64(sorted[i-1])/alignment {
+			return 0, 0, 0, fmt.Errorf("%w locations %d and %d, in the same allocation unit",
+				ErrBadEndPointer, sorted[i-1], blk)
+		}
+		locs[i] = entries.EndPointerLoca{Blk: blk}
+	}
+
+	// Try the gap before each end pointer, and after the last
+	gapStart := first
+	for i := 0; i <= len(sorted); i++ {
+		gapEnd := alignDown(diskBlks, alignment)
+		if i < len(sorted) {
+			gapEnd = alignDown(int64(sorted[i]), alignment)
+		}
+		start := alignUp(gapStart, alignment)
+		if gapEnd-start > areaEnd-areaStart {
+			head, areaStart, areaEnd = i, start, gapEnd
+		}
+		if i < len(sorted) {
+			gapStart = int64(sorted[i]) + 1
+		}
+	}
+	return head, areaStart, areaEnd, nil
+}
+
+// checkResumable checks Output already has the header that would be
+// written, and that no image has been added since.
+func checkResumable(conf *NewArchiveOptions, header entries.ArchiveHeaderWrite, headPointers int, sentinelEnd int64, blockSize int64) error {
+	r, ok := conf.Output.(io.ReaderAt)
+	if !ok {
+		return errors.New("Output can't be read to check it before resuming")
+	}
+
+	var want bytes.Buffer
+	if err := writeMultipleEntries(&want, header); err != nil {
 		return err
 	}
+	got := make([]byte, want.Len())
+	if n, err := r.ReadAt(got, 0); n != len(got) {
+		return fmt.Errorf("Error reading existing header %v", err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		return errors.New("Existing header doesn't match the options, can't resume")
+	}
+
+	for _, e := range header.EndPointerLoca[:headPointers] {
+		// The header matched, so the archive is little-endian
+		pointsTo, ok, err := VerifyEndPointer(r, e.Blk, blockSize, conf.EndPointerChecksum, binary.LittleEndian)
+		if err != nil {
+			return err
+		}
+		if !ok || pointsTo != sentinelEnd*blockSize {
+			return fmt.Errorf("End pointer at block %d isn't that of an empty archive, can't resume", e.Blk)
+		}
+	}
 
 	return nil
 }
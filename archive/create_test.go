@@ -0,0 +1,96 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readSeededFill(t *testing.T, conf RandReaderConf, size int64) []byte {
+	t.Helper()
+	RandReaderInitConf(&conf)
+	defer RandReaderClose()
+	var buf bytes.Buffer
+	if _, err := writeRandom(&buf, size); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSeededFillIgnoresWorkers(t *testing.T) {
+	seed := []byte("seed")
+	const size = 100000
+	want := readSeededFill(t, RandReaderConf{Seed: seed, Workers: 1, BufferSize: 4096}, size)
+	for _, conf := range []RandReaderConf{
+		{Seed: seed, Workers: 3, BufferSize: 4096},
+		{Seed: seed, Workers: 2, BufferSize: 1000},
+		{Seed: seed, Workers: 5, BufferSize: 65536},
+		{Seed: seed},
+	} {
+		if got := readSeededFill(t, conf, size); !bytes.Equal(got, want) {
+			t.Errorf("Workers %d, BufferSize %d: fill differs", conf.Workers, conf.BufferSize)
+		}
+	}
+
+	other := readSeededFill(t, RandReaderConf{Seed: []byte("other"), Workers: 1, BufferSize: 4096}, size)
+	if bytes.Equal(other, want) {
+		t.Error("Different seeds give the same fill")
+	}
+}
+
+func TestCtrAtCarries(t *testing.T) {
+	iv := []byte{0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	want := []byte{0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 1}
+	if got := ctrAt(iv, 2); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+// writeZerosBlocks is writeZeros as it was, one block per write
+func writeZerosBlocks(w io.Writer, size int64) (int64, error) {
+	var zeros [BlockSize]byte
+	n, err := w.Write(zeros[:size&(BlockSize-1)])
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	for i := size / BlockSize; i != 0; i-- {
+		n, err := w.Write(zeros[:])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func BenchmarkWriteZeros(b *testing.B) {
+	f, err := os.Create(filepath.Join(b.TempDir(), "zeros"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	const size = 16 << 20
+	for _, fill := range []struct {
+		name string
+		f    func(io.Writer, int64) (int64, error)
+	}{
+		{"1MiB", writeZeros},
+		{"block", writeZerosBlocks},
+	} {
+		b.Run(fill.name, func(b *testing.B) {
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := fill.f(f, size); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
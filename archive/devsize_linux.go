@@ -0,0 +1,21 @@
+package archive
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const ioctlBlkGetSize64 = 0x80081272 // _IOR(0x12, 114, size_t)
+
+// blockDeviceSize returns the size of a block device in bytes, with
+// BLKGETSIZE64.
+func blockDeviceSize(f *os.File) (int64, error) {
+	var size uint64
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		ioctlBlkGetSize64, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int64(size), nil
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package archive
+
+import (
+	"io"
+	"os"
+)
+
+func blockDeviceSize(f *os.File) (int64, error) {
+	cur, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Seek(cur, io.SeekStart)
+	return size, err
+}
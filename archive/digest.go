@@ -0,0 +1,46 @@
+package archive
+
+import (
+	"errors"
+	"hash"
+	"io"
+
+	// Hashes offered for ExtractOptions.Digest
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// hashingSeeker hashes what is written through it.  Seeking forward
+// leaves a hole in the file, which is hashed as zeros.
+type hashingSeeker struct {
+	w   io.WriteSeeker
+	h   hash.Hash
+	pos int64
+}
+
+func (w *hashingSeeker) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.h.Write(p[:n])
+	w.pos += int64(n)
+	return n, err
+}
+
+func (w *hashingSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += w.pos
+	default:
+		return w.pos, errors.New("Can only seek from the start or the current position while hashing")
+	}
+	if offset < w.pos {
+		return w.pos, errors.New("Can't seek backwards while hashing")
+	}
+
+	if _, err := w.w.Seek(offset, io.SeekStart); err != nil {
+		return w.pos, err
+	}
+	writeZeros(w.h, offset-w.pos)
+	w.pos = offset
+	return w.pos, nil
+}
@@ -0,0 +1,21 @@
+package archive
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const ioctlBlkDiscard = 0x1277 // _IO(0x12, 119)
+
+// discardRange issues BLKDISCARD on a block device.  start and length
+// are in bytes.
+func discardRange(f *os.File, start, length int64) error {
+	r := [2]uint64{uint64(start), uint64(length)}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(),
+		ioctlBlkDiscard, uintptr(unsafe.Pointer(&r)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package archive
+
+import (
+	"errors"
+	"os"
+)
+
+func discardRange(f *os.File, start, length int64) error {
+	return errors.New("Discard is not supported on this platform")
+}
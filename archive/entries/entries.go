@@ -1,6 +1,8 @@
 package entries
 
 import (
+	"encoding/binary"
+	"fmt"
 	"reflect"
 )
 
@@ -13,6 +15,20 @@ type EntryCommon struct {
 	Size uint32
 }
 
+// UnknownEntry is an entry of a type that isn't registered, as read.
+type UnknownEntry struct {
+	At   int // byte position in the header or ending
+	ID   EntryTypeID
+	Data []byte
+}
+
+// RawEntry is an entry of a type that isn't registered, kept as read so
+// it can be written back unchanged.
+type RawEntry struct {
+	ID   EntryTypeID
+	Data []byte
+}
+
 var IdCvtmMagic EntryTypeID = EntryTypeID{'C', 'V', 'T', 'M', '-', 'M', 'A', 'G', 'I', 'C', 0, 0, 0, 0, 0, 0}
 
 type CvtmMagic struct {
@@ -23,9 +39,25 @@ type CvtmMagic struct {
 var IdAllocateOnce EntryTypeID = EntryTypeID{'A', 'L', 'L', 'O', 'C', 'A', 'T', 'E', '-', 'O', 'N', 'C', 'E', 0, 0, 0}
 
 type AllocateOnce struct {
+	// Blocks the device allocates at a time, 0 if not known
 	AllocationIncrement uint32
 }
 
+var IdBlockSize EntryTypeID = EntryTypeID{'B', 'L', 'O', 'C', 'K', '-', 'S', 'I', 'Z', 'E', 0, 0, 0, 0, 0, 0}
+
+// The block size is 512<<SizeExp bytes
+type BlockSize struct {
+	SizeExp byte
+}
+
+var IdClusterCheck EntryTypeID = EntryTypeID{'C', 'L', 'U', 'S', 'T', 'E', 'R', '-', 'C', 'H', 'E', 'C', 'K', 0, 0, 0}
+
+// If present, each L2 table of an image is followed by a cluster of
+// checksums of the data clusters it points to, in the same order
+type ClusterCheck struct {
+	Algo uint32
+}
+
 var IdEndPointerChec EntryTypeID = EntryTypeID{'E', 'N', 'D', '-', 'P', 'O', 'I', 'N', 'T', 'E', 'R', '-', 'C', 'H', 'E', 'C'}
 
 type EndPointerChec struct {
@@ -58,6 +90,22 @@ type GlobalLogLocat struct {
 	Count uint32
 }
 
+var IdGlobalLogCheck EntryTypeID = EntryTypeID{'G', 'L', 'O', 'B', 'A', 'L', '-', 'L', 'O', 'G', '-', 'C', 'H', 'E', 'C', 'K'}
+
+// Checksum of the global log at index Log of the GlobalLogLocat
+// entries, with a header checksum algorithm
+type GlobalLogCheck struct {
+	Log      uint32
+	Algo     uint32
+	Checksum [32]byte
+}
+
+var IdHeaderChecksum EntryTypeID = EntryTypeID{'H', 'E', 'A', 'D', 'E', 'R', '-', 'C', 'H', 'E', 'C', 'K', 'S', 'U', 'M', 0}
+
+type HeaderChecksum struct {
+	Algo uint32
+}
+
 var IdImageArea EntryTypeID = EntryTypeID{'I', 'M', 'A', 'G', 'E', '-', 'A', 'R', 'E', 'A', 0, 0, 0, 0, 0, 0}
 
 type ImageArea struct {
@@ -78,6 +126,13 @@ type ImageLog struct {
 	BlkCount uint32
 }
 
+var IdImgCompression EntryTypeID = EntryTypeID{'I', 'M', 'G', '-', 'C', 'O', 'M', 'P', 'R', 'E', 'S', 'S', 'I', 'O', 'N', 0}
+
+// How each allocated data cluster of the images is compressed
+type ImgCompression struct {
+	Algo uint32
+}
+
 var IdSdCid EntryTypeID = EntryTypeID{'S', 'D', '-', 'C', 'I', 'D', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
 
 type SdCid struct {
@@ -100,6 +155,14 @@ type Ending struct {
 	ClustersOffset   uint32
 }
 
+var IdWideClusters EntryTypeID = EntryTypeID{'W', 'I', 'D', 'E', '-', 'C', 'L', 'U', 'S', 'T', 'E', 'R', 'S', 0, 0, 0}
+
+// In an ending, the image has DataClusterCount data clusters instead of
+// Ending's, and the indices in its cluster tables are 8 bytes
+type WideClusters struct {
+	DataClusterCount uint64
+}
+
 var IdImageKey EntryTypeID = EntryTypeID{'I', 'M', 'A', 'G', 'E', '-', 'K', 'E', 'Y', 0, 0, 0, 0, 0, 0, 0}
 
 type ImageKey struct {
@@ -113,48 +176,119 @@ type ImageLogLocati struct {
 	Size   uint32
 }
 
+var IdPrevEndingSize EntryTypeID = EntryTypeID{'P', 'R', 'E', 'V', '-', 'E', 'N', 'D', 'I', 'N', 'G', '-', 'S', 'I', 'Z', 'E'}
+
+// In an ending, the size in blocks of the ending Ending.Prev points
+// to, so it can be read without trying sizes
+type PrevEndingSize struct {
+	Size uint32
+}
+
 var TypeToID map[reflect.Type]EntryTypeID = map[reflect.Type]EntryTypeID{
 	reflect.TypeOf(CvtmMagic{}):      IdCvtmMagic,
 	reflect.TypeOf(AllocateOnce{}):   IdAllocateOnce,
+	reflect.TypeOf(BlockSize{}):      IdBlockSize,
+	reflect.TypeOf(ClusterCheck{}):   IdClusterCheck,
 	reflect.TypeOf(EndPointerChec{}): IdEndPointerChec,
 	reflect.TypeOf(EndPointerLoca{}): IdEndPointerLoca,
 	reflect.TypeOf(EndingCipher{}):   IdEndingCipher,
 	reflect.TypeOf(EndingSize{}):     IdEndingSize,
 	reflect.TypeOf(GlobalLogLocat{}): IdGlobalLogLocat,
+	reflect.TypeOf(GlobalLogCheck{}): IdGlobalLogCheck,
+	reflect.TypeOf(HeaderChecksum{}): IdHeaderChecksum,
 	reflect.TypeOf(ImageArea{}):      IdImageArea,
 	reflect.TypeOf(ImageBasic{}):     IdImageBasic,
 	reflect.TypeOf(ImageLog{}):       IdImageLog,
+	reflect.TypeOf(ImgCompression{}): IdImgCompression,
 	reflect.TypeOf(SdCid{}):          IdSdCid,
 	reflect.TypeOf(NoMoreImages{}):   IdNoMoreImages,
 	reflect.TypeOf(Ending{}):         IdEnding,
+	reflect.TypeOf(WideClusters{}):   IdWideClusters,
 	reflect.TypeOf(ImageKey{}):       IdImageKey,
 	reflect.TypeOf(ImageLogLocati{}): IdImageLogLocati,
+	reflect.TypeOf(PrevEndingSize{}): IdPrevEndingSize,
+}
+
+// IDToType is the reverse of TypeToID.
+var IDToType map[EntryTypeID]reflect.Type = make(map[EntryTypeID]reflect.Type)
+
+func init() {
+	for typ, id := range TypeToID {
+		IDToType[id] = typ
+	}
+}
+
+// RegisterEntryType adds an entry type defined outside this package, so
+// it can be written in Optional and is read back into Optional.
+// example is a value of the type, a struct of fixed size fields and at
+// most one []byte, anywhere.  Register from an init function, because the
+// maps aren't locked.  It panics if the ID or the type is taken.
+func RegisterEntryType(id EntryTypeID, example interface{}) {
+	typ := reflect.TypeOf(example)
+	if typ.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("entry type %s isn't a struct", typ))
+	}
+	if _, ok := TypeToID[typ]; ok {
+		panic(fmt.Sprintf("entry type %s registered twice", typ))
+	}
+	if _, ok := IDToType[id]; ok {
+		panic(fmt.Sprintf("entry ID %q registered twice", id[:]))
+	}
+	TypeToID[typ] = id
+	IDToType[id] = typ
 }
 
 type ArchiveHeaderWrite struct {
-	CvtmMagic      CvtmMagic
+	CvtmMagic CvtmMagic
+	// Left out for 512 byte blocks, so such headers stay the same
+	BlockSize []BlockSize
+	// Left out unless asked for
+	ClusterCheck   []ClusterCheck
 	EndPointerChec EndPointerChec
 	EndPointerLoca []EndPointerLoca
 	EndingCipher   EndingCipher
 	EndingSize     EndingSize
 	GlobalLogLocat []GlobalLogLocat
+	// Left out unless asked for
+	GlobalLogCheck []GlobalLogCheck
+	// Left out for SHA-256, so such headers stay the same
+	HeaderChecksum []HeaderChecksum
 	ImageArea      ImageArea
 	ImageBasic     ImageBasic
 	ImageLog       []ImageLog
-	Optional       []Entry
+	// Left out for uncompressed images, so such headers stay the same
+	ImgCompression []ImgCompression
+	// Left out if no SD card is recorded
+	SdCid    []SdCid
+	Optional []Entry
 }
 
 type ArchiveHeaderRead struct {
+	CvtmMagic      CvtmMagic
 	AllocateOnce   AllocateOnce
+	BlockSize      BlockSize
+	ClusterCheck   ClusterCheck
 	EndPointerChec EndPointerChec
 	EndPointerLoca []EndPointerLoca
 	EndingCipher   EndingCipher
 	EndingSize     EndingSize
 	GlobalLogLocat []GlobalLogLocat
+	GlobalLogCheck []GlobalLogCheck
+	HeaderChecksum HeaderChecksum
 	ImageArea      ImageArea
 	ImageBasic     ImageBasic
 	ImageLog       []ImageLog
+	ImgCompression ImgCompression
 	SdCid          SdCid
+	// Entries not taken by the fields above, in the order they are
+	// in the header.  Those of types not registered are RawEntry.
+	Optional []Entry
+	// Entries of types not registered, so the archive may use
+	// features not supported
+	UnknownEntries []UnknownEntry
+	// Byte order of the numbers in the archive, as found when reading
+	// the header.  It isn't an entry.
+	ByteOrder binary.ByteOrder `entry:"-"`
 }
 
 type EndingRead struct {
@@ -162,4 +296,11 @@ type EndingRead struct {
 	Ending         Ending
 	ImageKey       ImageKey
 	ImageLogLocati []ImageLogLocati
+	// Overrides the header's if not 0
+	EndingSize EndingSize
+	// Overrides the header's for the previous ending if not 0
+	PrevEndingSize PrevEndingSize
+	// Used instead of Ending.DataClusterCount if not 0
+	WideClusters   WideClusters
+	UnknownEntries []UnknownEntry
 }
@@ -4,34 +4,231 @@ import (
 	"./entries"
 	"bufio"
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math"
 	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strings"
 	"text/template"
+	"text/template/parse"
 )
 
 const (
-	maxHeaderSize = 0x100000
-	maxEndingSize = 32
+	maxHeaderSize     = 0x100000
+	maxEndingSize     = 32
+	maxClusterSizeExp = 20
+	// Largest MaxHeaderSize honored, so a corrupt length can't take
+	// all the memory whatever the option is
+	hardMaxHeaderSize = 0x10000000
 )
 
+// ArchiveFile is what an archive is read from, like an *os.File or a
+// MemFile.
+type ArchiveFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
 type ExtractOptions struct {
-	File       *os.File
+	File ArchiveFile
+	// Key for decrypting endings.
+	//
+	// Deprecated: Use PrivateKeys.  If not nil, it is tried first.
 	PrivateKey *rsa.PrivateKey
-	ImageNames *template.Template
-	Overwrite  bool
-	Raw        bool
+	// Candidate keys for decrypting endings.  Each is tried in
+	// turn, so images sealed under different keys can be read.
+	PrivateKeys []*rsa.PrivateKey
+	ImageNames  *template.Template
+	Overwrite   bool
+	// Without Overwrite, leave outputs that already exist, and
+	// mark their images Skipped
+	SkipExisting bool
+	// If not 0, missing parent directories of outputs are created
+	// with this mode, less the umask
+	DirMode os.FileMode
+	// If not empty, names from ImageNames are taken to be in this
+	// directory, which is created if missing
+	OutputDir string
+	// Copy images as they are stored, without converting them to
+	// QCOW2 or expanding compressed clusters
+	Raw bool
+	// Check each data cluster against its checksum, if the archive
+	// has them.  Not used with Raw.
+	VerifyClusters bool
+	// If not nil, the name of the backing file of each image, like
+	// ImageNames.  Clusters not in the image are then read from the
+	// backing file, not as zeros.  No backing file is set for an
+	// image if the name is empty.  Not used with Raw.
+	BackingFile *template.Template
+	// Treat anomalies that don't stop the archive being read as
+	// errors
+	Strict bool
+	// Types of entries that must be complete in strict mode.
+	// Overrides DefaultEssentialEntries if not nil.
+	EssentialEntries map[entries.EntryTypeID]bool
+	// Only log a header checksum mismatch, so a header with a few
+	// bad bits can still be read
+	ForceHeader bool
+	// Largest header accepted, in bytes.  Defaults to 1MiB if 0,
+	// and is at most 256MiB.
+	MaxHeaderSize uint32
+	// Indices of images to extract.  All images are extracted if
+	// both this and IndexRanges are nil.
+	Indices []int
+	// Ranges of indices of images to extract, along with Indices.
+	// A long range isn't expanded, so it takes no memory.
+	IndexRanges []IndexRange
+	// Most images walked through in the chain of endings.
+	// Unlimited if 0.
+	MaxImages int
+	// Most entries of each type accepted in a header or ending.
+	// Overrides DefaultMaxEntries.
+	MaxEntries map[entries.EntryTypeID]int
+	// When an image is extracted onto a block device, check it is
+	// the SD card whose CID is in the header before writing
+	CheckSdCid bool
+	// Only log a failed SD card check
+	ForceSdCid bool
+	// Size in bytes of the buffers for reading cluster indices and
+	// writing QCOW2 tables.  4KiB if 0.
+	ReadBufferSize int
+	// Allocate the whole of each output file before writing it
+	Preallocate bool
+	// Flush each output to stable storage before going on, along
+	// with the directory of a file created
+	Sync bool
+	// If more than 1, data is read with this many reads at once, up
+	// to Threads.  May be faster for big images on fast storage.
+	CopyWorkers int
+	// Write outputs in order without seeking, so they can be pipes.
+	// An image named "-" is written to stdout this way.
+	Stream bool
+	// Skip images that can't be extracted, instead of stopping.  The
+	// images extracted are returned along with an error listing an
+	// ImageError for each image skipped.
+	Salvage bool
+	// Compress the whole output of each image.  The extension, like
+	// .gz, is appended to the name.
+	Compression uint32
+	// If not 0, the digest of each output, as written, is computed
+	// with this hash.
+	Digest crypto.Hash
+	// Byte order of the numbers in the archive.  If nil, ReadHeader
+	// finds it from the header.  Either way it is kept in
+	// ArchiveHeaderRead.ByteOrder.
+	ByteOrder binary.ByteOrder
+}
+
+// IndexRange is the indices from First to Last, inclusive.
+type IndexRange struct {
+	First int
+	Last  int
+}
+
+// DefaultMaxEntries limits how many entries of a type are accepted, so
+// a crafted archive can't make huge allocations.  Types not listed
+// aren't limited.
+var DefaultMaxEntries = map[entries.EntryTypeID]int{
+	entries.IdEndPointerLoca: 1024,
+	entries.IdGlobalLogLocat: 1024,
+	entries.IdGlobalLogCheck: 1024,
+	entries.IdImageLog:       1024,
+	entries.IdImageLogLocati: 1024,
+}
+
+// DefaultEssentialEntries are the types of entries that must have all
+// their fields in strict mode.  A short entry of another type is
+// accepted, as it may be from an older version.
+var DefaultEssentialEntries = map[entries.EntryTypeID]bool{
+	entries.IdCvtmMagic:      true,
+	entries.IdEndPointerLoca: true,
+	entries.IdEndingSize:     true,
+	entries.IdImageArea:      true,
+	entries.IdImageBasic:     true,
+	entries.IdEnding:         true,
+}
+
+func (options *ExtractOptions) mustBeComplete(typeID entries.EntryTypeID) bool {
+	if !options.Strict {
+		return false
+	}
+	if options.EssentialEntries != nil {
+		return options.EssentialEntries[typeID]
+	}
+	return DefaultEssentialEntries[typeID]
+}
+
+// bufferSize returns ReadBufferSize, or bufio's default if 0.
+func (options *ExtractOptions) bufferSize() int {
+	if options.ReadBufferSize > 0 {
+		return options.ReadBufferSize
+	}
+	return 4096
 }
 
+// Close closes File if it can be closed, for when options were filled
+// in to read one archive.  File is then nil.
+func (options *ExtractOptions) Close() error {
+	f := options.File
+	options.File = nil
+	if c, ok := f.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// privateKeys returns the keys to try, PrivateKey first.
+func (options *ExtractOptions) privateKeys() []*rsa.PrivateKey {
+	if options.PrivateKey == nil {
+		return options.PrivateKeys
+	}
+	return append([]*rsa.PrivateKey{options.PrivateKey}, options.PrivateKeys...)
+}
+
+func (options *ExtractOptions) maxEntries(typeID entries.EntryTypeID) (int, bool) {
+	if limit, ok := options.MaxEntries[typeID]; ok {
+		return limit, true
+	}
+	limit, ok := DefaultMaxEntries[typeID]
+	return limit, ok
+}
+
+// Errors that can be tested for with errors.Is.  Errors returned
+// wrap them with the details.
+var (
+	ErrTruncatedHeader    = errors.New("got EOF reading header")
+	ErrBadMagic           = errors.New("bad magic number")
+	ErrBadHeaderSize      = errors.New("bad header size")
+	ErrHeaderTooBig       = errors.New("header size too big")
+	ErrBadChecksum        = errors.New("bad checksum")
+	ErrBadEntry           = errors.New("Bad entry")
+	ErrTooManyEntries     = errors.New("Too many entries")
+	ErrUnknownEnum        = errors.New("Unknown enumeration value")
+	ErrBadEndPointer      = errors.New("Bad end pointer")
+	ErrNoEndPointer       = errors.New("No valid end pointer exists")
+	ErrBadEnding          = errors.New("Bad ending")
+	ErrTooManyImages      = errors.New("Too many images")
+	ErrImageStartAfterEnd = errors.New("Image start is after end")
+	ErrBadImageKey        = errors.New("Bad image key")
+	ErrImageCompressed    = errors.New("Random access to compressed images isn't supported")
+	ErrArchiveFull        = errors.New("Not enough space in image area")
+	ErrUnsupportedQcow2   = errors.New("Unsupported QCOW2 image")
+	ErrPrivateKeyRequired = errors.New("Archive is encrypted, but private key is not given")
+	ErrWrongKey           = errors.New("No private key decrypts the ending")
+)
+
 // Read archive header
 
 type badEntry struct {
@@ -43,6 +240,14 @@ func (err badEntry) Error() string {
 	return fmt.Sprintf("Bad entry at %d: %s", err.pos, err.err.Error())
 }
 
+func (err badEntry) Is(target error) bool {
+	return target == ErrBadEntry
+}
+
+func (err badEntry) Unwrap() error {
+	return err.err
+}
+
 type unknownEnum struct {
 	name  string
 	value uint32
@@ -52,6 +257,10 @@ func (e unknownEnum) Error() string {
 	return fmt.Sprintf("Unknown enumeration value %s %d", e.name, e.value)
 }
 
+func (e unknownEnum) Is(target error) bool {
+	return target == ErrUnknownEnum
+}
+
 type errorList []error
 
 func (e errorList) Error() string {
@@ -62,48 +271,100 @@ func (e errorList) Error() string {
 	return strings.Join(st, ", ")
 }
 
+func (e errorList) Unwrap() []error {
+	return e
+}
+
+// ImageError records which image an error occurred at.  Pos is the
+// byte position of the end of its ending.
+type ImageError struct {
+	Index int
+	Pos   int64
+	Err   error
+}
+
+func (e *ImageError) Error() string {
+	return fmt.Sprintf("Image %d at %d: %s", e.Index, e.Pos, e.Err.Error())
+}
+
+func (e *ImageError) Unwrap() error {
+	return e.Err
+}
+
+// EndPointerError records which end pointer couldn't be used.
+type EndPointerError struct {
+	Blk uint32
+	Err error
+}
+
+func (e *EndPointerError) Error() string {
+	return fmt.Sprintf("End pointer at block %d: %s", e.Blk, e.Err.Error())
+}
+
+func (e *EndPointerError) Unwrap() error {
+	return e.Err
+}
+
 type entryRead struct {
 	at   int
 	data []byte
 }
 
-func parseEntry(ent entryRead, dest reflect.Value) error {
-	err := binary.Read(bytes.NewReader(ent.data), binary.LittleEndian, dest.Interface())
-	if err == io.EOF {
-		// Because the format allows fields to be added, an
-		// entry missing some fields should not be an error.
-		log.Println("Entry is shorter than expected at ", ent.at)
-		return nil
-	} else if err == io.ErrUnexpectedEOF {
-		// But a field being incomplete shouldn't happen.
-		return badEntry{ent.at, errors.New("Field is incomplete")}
+// parseEntry parses ent into dest.  If complete, ent must have all the
+// fields of dest.
+func parseEntry(ent entryRead, dest reflect.Value, complete bool, order binary.ByteOrder) error {
+	// Only byte slices are supported as variable size fields.  A
+	// slice takes whatever the fixed size fields leave, wherever
+	// it is in the entry.
+	fixedSize := 0
+	for i := 0; i < dest.NumField(); i++ {
+		if v := dest.Field(i); v.Kind() != reflect.Slice {
+			fixedSize += binary.Size(v.Interface())
+		} else if v.Type().Elem().Kind() != reflect.Uint8 {
+			gotBadType(v.Type())
+		}
 	}
 
-	// There is an error.  It's probably because binary doesn't read
-	// into byte slices.  Handle them manually.
-
 	r := bytes.NewReader(ent.data)
-	err = forEachField(dest, func(v reflect.Value) error {
+	for i := 0; i < dest.NumField(); i++ {
+		v := dest.Field(i)
+
 		if v.Kind() == reflect.Slice {
-			// Only byte slices are supported.  And it is
-			// expected to be the last field.
-			at := ftell(r)
-			if int(at) != len(ent.data) {
-				v.Set(reflect.ValueOf(ent.data[at:]))
+			n := len(ent.data) - fixedSize
+			if n <= 0 {
+				continue
 			}
-			return nil
+			at := len(ent.data) - r.Len()
+			v.SetBytes(ent.data[at : at+n])
+			if _, err := r.Seek(int64(n), io.SeekCurrent); err != nil {
+				return badEntry{ent.at, err}
+			}
+			continue
 		}
-		return binary.Read(r, binary.LittleEndian, v.Addr().Interface())
-	})
 
-	if err != nil {
-		return badEntry{ent.at, err}
+		if r.Len() == 0 {
+			if complete {
+				return badEntry{ent.at, fmt.Errorf("Entry %s is missing field %s",
+					dest.Type().Name(), dest.Type().Field(i).Name)}
+			}
+			// Because the format allows fields to be added, an
+			// entry missing some fields should not be an error.
+			Warn.Println("Entry is shorter than expected at", ent.at)
+			return nil
+		}
+		err := binary.Read(r, order, v.Addr().Interface())
+		if err == io.ErrUnexpectedEOF {
+			// But a field being incomplete shouldn't happen.
+			return badEntry{ent.at, errors.New("Field is incomplete")}
+		} else if err != nil {
+			return badEntry{ent.at, err}
+		}
 	}
 
 	return nil
 }
 
-func splitEntries(data []byte, start int) (map[entries.EntryTypeID][]entryRead, error) {
+func splitEntries(data []byte, start int, order binary.ByteOrder) (map[entries.EntryTypeID][]entryRead, error) {
 	result := make(map[entries.EntryTypeID][]entryRead)
 
 	for {
@@ -113,8 +374,10 @@ func splitEntries(data []byte, start int) (map[entries.EntryTypeID][]entryRead,
 		if len(data) < 20 {
 			return nil, badEntry{start, errors.New("entry crosses header boundary")}
 		}
-		entSize := int(binary.LittleEndian.Uint32(data[16:20]))
-		if entSize > len(data) {
+		entSize := int(order.Uint32(data[16:20]))
+		if entSize < 20 {
+			return nil, badEntry{start, fmt.Errorf("entry size %d smaller than its ID and size", entSize)}
+		} else if entSize > len(data) {
 			return nil, badEntry{start, errors.New("entry crosses header boundary")}
 		}
 		var typeID entries.EntryTypeID
@@ -127,21 +390,51 @@ func splitEntries(data []byte, start int) (map[entries.EntryTypeID][]entryRead,
 	return result, nil
 }
 
-func parseEntries(data []byte, bytesSkipped int, result interface{}) error {
+var unknownEntriesType = reflect.TypeOf([]entries.UnknownEntry(nil))
+
+func parseEntries(data []byte, bytesSkipped int, result interface{}, options *ExtractOptions, order binary.ByteOrder) error {
 	// Split data into entries
 
-	ent, err := splitEntries(data, bytesSkipped)
+	ent, err := splitEntries(data, bytesSkipped, order)
 	if err != nil {
 		return err
 	}
 
+	var unknown []entries.UnknownEntry
+	for typeID, ent := range ent {
+		if _, ok := entries.IDToType[typeID]; ok {
+			continue
+		}
+		for _, ent := range ent {
+			unknown = append(unknown, entries.UnknownEntry{
+				At:   ent.at,
+				ID:   typeID,
+				Data: ent.data,
+			})
+		}
+	}
+	sort.Slice(unknown, func(i, j int) bool {
+		return unknown[i].At < unknown[j].At
+	})
+
 	// Parse entries
 
 	err = forEachField(reflect.ValueOf(result).Elem(), func(v reflect.Value) error {
 		var typeID entries.EntryTypeID
 
+		if v.Type() == unknownEntriesType {
+			v.Set(reflect.ValueOf(unknown))
+			return nil
+		}
+
 		switch v.Kind() {
 		case reflect.Slice:
+			if v.Type().Elem().Kind() == reflect.Interface {
+				// Any entry left is taken, so this must
+				// be the last field
+				return parseOptionalEntries(ent, v, options, order)
+			}
+
 			// Multiple such entries are expected
 			typ := v.Type()
 			typeID = getTypeID(typ.Elem())
@@ -149,10 +442,15 @@ func parseEntries(data []byte, bytesSkipped int, result interface{}) error {
 			if len(toParse) == 0 {
 				break
 			}
+			if limit, ok := options.maxEntries(typeID); ok && len(toParse) > limit {
+				return badEntry{toParse[limit].at, fmt.Errorf(
+					"%w %#v, %d, max %d", ErrTooManyEntries,
+					string(bytes.TrimRight(typeID[:], "\x00")), len(toParse), limit)}
+			}
 			result := reflect.MakeSlice(typ, len(toParse), len(toParse))
 			v.Set(result)
 			for i, ent := range toParse {
-				err := parseEntry(ent, result.Index(i))
+				err := parseEntry(ent, result.Index(i), options.mustBeComplete(typeID), order)
 				if err != nil {
 					return err
 				}
@@ -167,9 +465,17 @@ func parseEntries(data []byte, bytesSkipped int, result interface{}) error {
 				break
 			}
 			if len(ent) > 1 {
-				log.Printf("found more than 1 entries %#v\n", typeID)
+				if options.Strict {
+					at := make([]int, len(ent))
+					for i, e := range ent {
+						at[i] = e.at
+					}
+					return badEntry{ent[1].at, fmt.Errorf("%d entries %#v, only 1 allowed, at %v",
+						len(ent), string(bytes.TrimRight(typeID[:], "\x00")), at)}
+				}
+				Warn.Printf("found more than 1 entries %#v\n", typeID)
 			}
-			err := parseEntry(ent[len(ent)-1], v)
+			err := parseEntry(ent[len(ent)-1], v, options.mustBeComplete(typeID), order)
 			if err != nil {
 				return err
 			}
@@ -188,42 +494,94 @@ func parseEntries(data []byte, bytesSkipped int, result interface{}) error {
 
 	for name, ent := range ent {
 		for _, ent := range ent {
-			log.Printf("unknown entry at %d %#v\n", ent.at, name)
+			Warn.Printf("unknown entry at %d %#v\n", ent.at, name)
 		}
 	}
 
 	return nil
 }
 
-func readArchiveHeader(options *ExtractOptions, result *entries.ArchiveHeaderRead) error {
-	earlyEOF := errors.New("got EOF reading header")
+// parseOptionalEntries parses all entries in ent into dest, a slice of
+// entries.Entry, in the order they were read.  Those of types not
+// registered are kept as entries.RawEntry.  ent is emptied.
+func parseOptionalEntries(ent map[entries.EntryTypeID][]entryRead, dest reflect.Value, options *ExtractOptions, order binary.ByteOrder) error {
+	type found struct {
+		id  entries.EntryTypeID
+		typ reflect.Type
+		ent entryRead
+	}
+	var toParse []found
+	for typeID, ents := range ent {
+		typ := entries.IDToType[typeID]
+		if limit, ok := options.maxEntries(typeID); ok && len(ents) > limit {
+			return badEntry{ents[limit].at, fmt.Errorf(
+				"%w %#v, %d, max %d", ErrTooManyEntries,
+				string(bytes.TrimRight(typeID[:], "\x00")), len(ents), limit)}
+		}
+		for _, e := range ents {
+			toParse = append(toParse, found{typeID, typ, e})
+		}
+		delete(ent, typeID)
+	}
+	sort.Slice(toParse, func(i, j int) bool {
+		return toParse[i].ent.at < toParse[j].ent.at
+	})
+
+	result := reflect.MakeSlice(dest.Type(), 0, len(toParse))
+	for _, e := range toParse {
+		if e.typ == nil {
+			Warn.Printf("unknown entry at %d %#v\n", e.ent.at, e.id)
+			result = reflect.Append(result, reflect.ValueOf(entries.RawEntry{
+				ID:   e.id,
+				Data: e.ent.data,
+			}))
+			continue
+		}
+		v := reflect.New(e.typ).Elem()
+		if err := parseEntry(e.ent, v, options.mustBeComplete(e.id), order); err != nil {
+			return err
+		}
+		result = reflect.Append(result, v)
+	}
+	dest.Set(result)
 
-	infile := bufio.NewReader(options.File)
+	return nil
+}
+
+// ReadHeader reads and parses the archive header without checking it
+// against the options.  The private key is not needed.  The header is
+// read from the start of options.File, whatever its position.
+func ReadHeader(options *ExtractOptions, result *entries.ArchiveHeaderRead) error {
+	infile := bufio.NewReader(io.NewSectionReader(options.File, 0, math.MaxInt64))
 
 	// Read first entry
 
 	data := make([]byte, 56)
-	if n, err := infile.Read(data); err != nil {
+	if _, err := io.ReadFull(infile, data); err == io.ErrUnexpectedEOF {
+		return ErrTruncatedHeader
+	} else if err != nil {
 		return err
-	} else if n != 56 {
-		return earlyEOF
 	}
 	if !bytes.Equal(entries.IdCvtmMagic[:], data[:16]) {
-		return errors.New("bad magic number")
+		return ErrBadMagic
+	}
+	order := options.ByteOrder
+	if order == nil {
+		order = detectByteOrder(data[16:20])
 	}
-	firstEntSize := int(binary.LittleEndian.Uint32(data[16:20]))
+	firstEntSize := int(order.Uint32(data[16:20]))
 	if firstEntSize < 56 {
-		return fmt.Errorf("bad entry size %d", firstEntSize)
+		return badEntry{0, fmt.Errorf("Bad size %d", firstEntSize)}
 	}
 	var firstEnt entries.CvtmMagic
-	if err := binary.Read(bytes.NewReader(data[20:]), binary.LittleEndian, &firstEnt); err != nil {
-		panic(err)
+	if err := binary.Read(bytes.NewReader(data[20:]), order, &firstEnt); err != nil {
+		return badEntry{0, fmt.Errorf("Error reading first entry: %w", err)}
 	}
 	headerSize := firstEnt.HeaderLength
 	if int(headerSize) < firstEntSize {
-		return fmt.Errorf("bad header size %d", headerSize)
-	} else if firstEnt.HeaderLength > maxHeaderSize {
-		return fmt.Errorf("header size too big %d", headerSize)
+		return fmt.Errorf("%w %d", ErrBadHeaderSize, headerSize)
+	} else if firstEnt.HeaderLength > headerSizeLimit(options.MaxHeaderSize) {
+		return fmt.Errorf("%w %d", ErrHeaderTooBig, headerSize)
 	}
 
 	// Read rest
@@ -233,49 +591,136 @@ func readArchiveHeader(options *ExtractOptions, result *entries.ArchiveHeaderRea
 		copy(data1, data)
 		data = data1
 	}
-	if n, err := infile.Read(data[56:]); err != nil {
+	if _, err := io.ReadFull(infile, data[56:]); err == io.ErrUnexpectedEOF || err == io.EOF {
+		return ErrTruncatedHeader
+	} else if err != nil {
 		return err
-	} else if n != int(headerSize-56) {
-		return earlyEOF
 	}
 
-	// Check checksum
+	// The checksum algorithm is given by an entry, so entries are
+	// parsed before checking the checksum.  A corrupted header
+	// usually fails parsing, which is reported as a bad checksum if
+	// no algorithm matches.
 
-	{
-		checksum1 := make([]byte, 32)
-		copy(checksum1, data[20:52])
-		for i := 20; i < 52; i++ {
-			data[i] = 0
-		}
-		checksum2 := sha256.Sum256(data)
-		if !bytes.Equal(checksum1, checksum2[:]) {
-			return errors.New("bad checksum")
-		}
+	checksum1 := make([]byte, 32)
+	copy(checksum1, data[20:52])
+	for i := 20; i < 52; i++ {
+		data[i] = 0
+	}
+	checksumMatches := func(algo uint32) (bool, error) {
+		checksum2, err := computeHeaderChecksum(data, algo)
+		return bytes.Equal(checksum1, checksum2[:]), err
 	}
 
 	// Parse
 
-	if err := parseEntries(data[firstEntSize:], firstEntSize, result); err != nil {
+	if err := parseEntries(data[firstEntSize:], firstEntSize, result, options, order); err != nil {
+		sha256OK, _ := checksumMatches(HeaderChecksumSHA256)
+		crc32cOK, _ := checksumMatches(HeaderChecksumCRC32C)
+		if !sha256OK && !crc32cOK && !options.ForceHeader {
+			return ErrBadChecksum
+		}
 		return err
 	}
 
+	// Check checksum
+
+	if ok, err := checksumMatches(result.HeaderChecksum.Algo); err != nil {
+		return err
+	} else if !ok {
+		if !options.ForceHeader {
+			return ErrBadChecksum
+		}
+		Warn.Println("Header checksum doesn't match, going on anyway")
+	}
+
+	result.CvtmMagic = firstEnt
+	result.ByteOrder = order
+
 	// Set default values
 
 	if result.EndingSize.Size == 0 {
 		result.EndingSize.Size = 1
 	}
 
-	if err := checkArchiveHeader(options, result, headerSize); err != nil {
+	return nil
+}
+
+// headerSizeLimit returns the largest header accepted with
+// ExtractOptions.MaxHeaderSize max.
+func headerSizeLimit(max uint32) uint32 {
+	if max == 0 {
+		return maxHeaderSize
+	} else if max > hardMaxHeaderSize {
+		return hardMaxHeaderSize
+	}
+	return max
+}
+
+// ReadRawHeader returns the archive header at the start of r as it is
+// stored, with the checksum in place, and the header length it
+// declares.  ReadHeader checks the checksum with the checksum field
+// zeroed, so a tool checking it independently has to do the same.
+// Nothing past the first entry is parsed.  maxSize limits the header
+// like ExtractOptions.MaxHeaderSize, so the same headers are accepted.
+func ReadRawHeader(r io.ReaderAt, maxSize uint32) ([]byte, uint32, error) {
+	data := make([]byte, 56)
+	if err := readFullAt(r, data, 0); err == io.ErrUnexpectedEOF {
+		return nil, 0, ErrTruncatedHeader
+	} else if err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(entries.IdCvtmMagic[:], data[:16]) {
+		return nil, 0, ErrBadMagic
+	}
+	order := detectByteOrder(data[16:20])
+	headerSize := order.Uint32(data[52:56])
+	if headerSize < 56 {
+		return nil, 0, fmt.Errorf("%w %d", ErrBadHeaderSize, headerSize)
+	} else if headerSize > headerSizeLimit(maxSize) {
+		return nil, 0, fmt.Errorf("%w %d", ErrHeaderTooBig, headerSize)
+	}
+
+	data = make([]byte, headerSize)
+	if err := readFullAt(r, data, 0); err == io.ErrUnexpectedEOF {
+		return nil, 0, ErrTruncatedHeader
+	} else if err != nil {
+		return nil, 0, err
+	}
+	return data, headerSize, nil
+}
+
+func readArchiveHeader(options *ExtractOptions, result *entries.ArchiveHeaderRead) error {
+	if err := ReadHeader(options, result); err != nil {
+		return err
+	}
+
+	if err := checkArchiveHeader(options, result, result.CvtmMagic.HeaderLength, true); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func checkArchiveHeader(options *ExtractOptions, header *entries.ArchiveHeaderRead, headerSize uint32) error {
+// checkArchiveHeader checks the header makes sense.  needKey is false
+// when endings are only written, which doesn't need the private key.
+func checkArchiveHeader(options *ExtractOptions, header *entries.ArchiveHeaderRead, headerSize uint32, needKey bool) error {
 	// Only add to errs when the error certainly renders the archive
-	// unreadable
+	// unreadable, or in strict mode
 	var errs errorList
+	warn := func(err error) {
+		if options.Strict {
+			errs = append(errs, err)
+		} else {
+			Warn.Println(err)
+		}
+	}
+
+	// The block size is needed to check the rest
+	if header.BlockSize.SizeExp > maxBlockSizeExp {
+		return fmt.Errorf("Block size exponent too big %d", header.BlockSize.SizeExp)
+	}
+	blockSize := uint32(HeaderBlockSize(header))
 
 	if header.EndingSize.Size > maxEndingSize {
 		errs = append(errs, fmt.Errorf("end pointer too big %d blocks", header.EndingSize.Size))
@@ -289,22 +734,32 @@ func checkArchiveHeader(options *ExtractOptions, header *entries.ArchiveHeaderRe
 		if err != nil {
 			// Because the public key is not needed to read
 			// the archive, only a warning is printed
-			log.Println("Bad public key in archive", err)
+			warn(fmt.Errorf("Bad public key in archive %v", err))
 			break
 		}
-		if options.PrivateKey == nil {
-			errs = append(errs, errors.New("Archive is encrypted, but private key is not given"))
+		if !needKey {
 			break
 		}
-		pub1 := options.PrivateKey.Public().(*rsa.PublicKey)
-		if !(pub.N.Cmp(pub1.N) == 0 && pub.E == pub1.E) {
-			log.Println("Public key from archive header doesn't match private key")
+		keys := options.privateKeys()
+		if len(keys) == 0 {
+			errs = append(errs, ErrPrivateKeyRequired)
+			break
+		}
+		matched := false
+		for _, key := range keys {
+			pub1 := key.Public().(*rsa.PublicKey)
+			if pub.N.Cmp(pub1.N) == 0 && pub.E == pub1.E {
+				matched = true
+			}
+		}
+		if !matched {
+			warn(errors.New("Public key from archive header doesn't match any private key"))
 		}
 	default:
 		errs = append(errs, unknownEnum{"EndingCipher.Algo", header.EndingCipher.Algo})
 	}
 
-	if header.EndPointerChec.Algo > 2 {
+	if _, ok := EndPointerChecksums[header.EndPointerChec.Algo]; !ok {
 		errs = append(errs, unknownEnum{"EndPointerChec.Algo", header.EndPointerChec.Algo})
 	}
 
@@ -312,16 +767,34 @@ func checkArchiveHeader(options *ExtractOptions, header *entries.ArchiveHeaderRe
 		errs = append(errs, errors.New("Archive has no end pointers"))
 	}
 
-	headerBlks := (headerSize + BlockSize - 1) / BlockSize
+	headerBlks := (headerSize + blockSize - 1) / blockSize
 
 	if headerBlks > header.ImageArea.Start {
-		log.Println("Header and image area overlap")
+		warn(errors.New("Header and image area overlap"))
+	}
+	// End pointers sharing a block, or an allocation unit of the
+	// device if the header gives it, would be updated together, so
+	// one interrupted write could destroy all of them.
+	alignment := int64(header.AllocateOnce.AllocationIncrement)
+	if alignment == 0 {
+		alignment = 1
 	}
+	endPointerSeen := make(map[int64]uint32)
 	for _, e := range header.EndPointerLoca {
 		if !((e.Blk >= headerBlks && e.Blk < header.ImageArea.Start) ||
 			(e.Blk >= header.ImageArea.End)) {
-			errs = append(errs, fmt.Errorf("Bad end pointer location %d", e.Blk))
+			errs = append(errs, fmt.Errorf("%w location %d", ErrBadEndPointer, e.Blk))
 		}
+		unit := int64(e.Blk) / alignment
+		if other, ok := endPointerSeen[unit]; ok {
+			if other == e.Blk {
+				errs = append(errs, fmt.Errorf("%w, more than 1 at %d", ErrBadEndPointer, e.Blk))
+			} else {
+				errs = append(errs, fmt.Errorf("%w locations %d and %d, in the same allocation unit",
+					ErrBadEndPointer, other, e.Blk))
+			}
+		}
+		endPointerSeen[unit] = e.Blk
 	}
 
 	if len(errs) != 0 {
@@ -332,35 +805,81 @@ func checkArchiveHeader(options *ExtractOptions, header *entries.ArchiveHeaderRe
 
 // Find ending
 
-func findEnd(infile *os.File, header *entries.ArchiveHeaderRead) (bytePos int64) {
-	send := make(chan int64)
+// VerifyEndPointer reads the end pointer at block blk and checks its
+// checksum.  blockSize is in bytes, and order is the archive's, like
+// ArchiveHeaderRead.ByteOrder.  pointsTo is the byte position it points
+// to.  ok is false if the checksum doesn't match.
+func VerifyEndPointer(r io.ReaderAt, blk uint32, blockSize int64, algo uint32, order binary.ByteOrder) (pointsTo int64, ok bool, err error) {
+	pointsTo, _, ok, err = verifyEndPointer(r, blk, blockSize, algo, order)
+	return
+}
+
+// verifyEndPointer is VerifyEndPointer, also returning the size in
+// blocks of the ending pointed to, 0 if it is the header's.
+func verifyEndPointer(r io.ReaderAt, blk uint32, blockSize int64, algo uint32, order binary.ByteOrder) (pointsTo int64, endingBlocks uint32, ok bool, err error) {
+	if _, ok := EndPointerChecksums[algo]; !ok {
+		return 0, 0, false, unknownEnum{"EndPointerChec.Algo", algo}
+	}
+
+	// One allocation for the block, the stored checksum, and the
+	// computed checksum
+	buf := make([]byte, blockSize+64)
+	block, stored, computed := buf[:blockSize], buf[blockSize:blockSize+32], buf[blockSize+32:]
 
-	for _, ent := range header.EndPointerLoca {
-		go func(at int64) {
-			buf := make([]byte, BlockSize)
+	if err := readFullAt(r, block, blockSize*int64(blk)); err != nil {
+		return 0, 0, false, err
+	}
+
+	copy(stored, block[:32])
+	if !bytes.Equal(stored, computeEndPointerChecksum(block, algo, computed)) {
+		return 0, 0, false, nil
+	}
 
-			if _, err := infile.ReadAt(buf, at); err != nil {
-				log.Println("Got error reading end pointer at", at, err)
-				send <- 0
+	return blockSize * int64(order.Uint32(block[32:36])), order.Uint32(block[36:40]), true, nil
+}
+
+// findEnd returns the newest position pointed to, the size in blocks
+// of the ending there, 0 if it is the header's, and the errors from the
+// end pointers that couldn't be used.
+func findEnd(infile io.ReaderAt, header *entries.ArchiveHeaderRead) (bytePos int64, endingBlocks uint32, errs errorList) {
+	type found struct {
+		pointsTo     int64
+		endingBlocks uint32
+		err          error
+	}
+	send := make(chan found)
+	blockSize := HeaderBlockSize(header)
+	// Limits the reads at once
+	sem := make(chan struct{}, threads())
+
+	for _, ent := range header.EndPointerLoca {
+		go func(blk uint32) {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			pointsTo, endingBlocks, ok, err := verifyEndPointer(infile, blk, blockSize, header.EndPointerChec.Algo, byteOrder(header))
+			if err != nil {
+				Warn.Println("Got error reading end pointer at block", blk, err)
+				send <- found{0, 0, &EndPointerError{blk, err}}
 				return
 			}
-
-			chkSum := make([]byte, 32)
-			copy(chkSum, buf[:32])
-			if !bytes.Equal(chkSum, computeEndPointerChecksum(buf, header.EndPointerChec.Algo)) {
-				log.Println("End pointer has bad checksum at", at)
-				send <- 0
+			if !ok {
+				Warn.Println("End pointer has bad checksum at block", blk)
+				send <- found{0, 0, &EndPointerError{blk, ErrBadChecksum}}
 				return
 			}
 
-			send <- BlockSize * int64(binary.LittleEndian.Uint32(buf[32:36]))
-		}(BlockSize * int64(ent.Blk))
+			send <- found{pointsTo, endingBlocks, nil}
+		}(ent.Blk)
 	}
 
 	for range header.EndPointerLoca {
 		a := <-send
-		if a > bytePos {
-			bytePos = a
+		if a.err != nil {
+			errs = append(errs, a.err)
+		}
+		if a.pointsTo > bytePos {
+			bytePos = a.pointsTo
+			endingBlocks = a.endingBlocks
 		}
 	}
 
@@ -371,10 +890,41 @@ func findEnd(infile *os.File, header *entries.ArchiveHeaderRead) (bytePos int64)
 
 var errNoMoreImages error = errors.New("No more images")
 
-func readEnding(end int64, result *entries.EndingRead, options *ExtractOptions, header *entries.ArchiveHeaderRead) error {
-	size := BlockSize * int64(header.EndingSize.Size)
+// endingBytes returns the size of an ending in bytes.  An ending can
+// give its own size, overriding the header's.
+func endingBytes(header *entries.ArchiveHeaderRead, ending *entries.EndingRead) int64 {
+	size := header.EndingSize.Size
+	if ending.EndingSize.Size != 0 {
+		size = ending.EndingSize.Size
+	}
+	return HeaderBlockSize(header) * int64(size)
+}
+
+// readEnding reads the ending of blocks blocks that ends at end, or of
+// the header's size if blocks is 0.  The size is recorded in the end
+// pointer or the newer ending, so it needn't be guessed.
+func readEnding(end int64, blocks uint32, result *entries.EndingRead, options *ExtractOptions, header *entries.ArchiveHeaderRead) error {
+	if blocks == 0 {
+		blocks = header.EndingSize.Size
+	} else if blocks > maxEndingSize {
+		return fmt.Errorf("%w, size %d blocks, max %d", ErrBadEnding, blocks, maxEndingSize)
+	}
+	if err := readEndingSized(end, blocks, result, options, header); err != nil {
+		return err
+	}
+	// Read at another size, it must say so itself
+	if blocks != header.EndingSize.Size && result.EndingSize.Size == 0 {
+		return fmt.Errorf("%w, read as %d blocks, gives no size", ErrBadEnding, blocks)
+	}
+	return nil
+}
+
+// readEndingSized reads an ending of blocks blocks that ends at end.
+// result is filled even if the ending gives another size.
+func readEndingSized(end int64, blocks uint32, result *entries.EndingRead, options *ExtractOptions, header *entries.ArchiveHeaderRead) error {
+	size := HeaderBlockSize(header) * int64(blocks)
 	if end < size {
-		return fmt.Errorf("Bad end pointer %d", end)
+		return fmt.Errorf("%w %d", ErrBadEndPointer, end)
 	}
 
 	data := make([]byte, size)
@@ -387,13 +937,37 @@ func readEnding(end int64, result *entries.EndingRead, options *ExtractOptions,
 	case EndingCipherNull:
 		break
 	case EndingCipherRSA:
+		keys := options.privateKeys()
+		if len(keys) == 0 {
+			return ErrPrivateKeyRequired
+		}
 		var err error
-		data, err = rsa.DecryptOAEP(sha256.New(), nil, options.PrivateKey, data, []byte{})
+		ciphertext := data
+		for _, key := range keys {
+			// The ciphertext is followed by random padding
+			if key.Size() > len(ciphertext) {
+				err = fmt.Errorf("Key too big for ending, %d bytes", key.Size())
+				continue
+			}
+			data, err = rsa.DecryptOAEP(sha256.New(), nil, key, ciphertext[:key.Size()], []byte{})
+			if err == nil {
+				break
+			}
+		}
+		// A damaged ending can't be told from one encrypted
+		// with another key
 		if err != nil {
-			return err
+			return fmt.Errorf("%w, %v", ErrWrongKey, err)
 		}
 	default:
-		panic(fmt.Sprintf("Unknown ending cipher %d", header.EndingCipher.Algo))
+		// checkArchiveHeader reports this, but a caller may
+		// go on anyway
+		return unknownEnum{"EndingCipher.Algo", header.EndingCipher.Algo}
+	}
+
+	// A decrypted ending can be of any length
+	if len(data) < 16 {
+		return fmt.Errorf("%w, only %d bytes", ErrBadEnding, len(data))
 	}
 
 	if bytes.Equal(entries.IdNoMoreImages[:], data[:16]) {
@@ -401,30 +975,168 @@ func readEnding(end int64, result *entries.EndingRead, options *ExtractOptions,
 	}
 
 	if !bytes.Equal(entries.IdEnding[:], data[:16]) {
-		return fmt.Errorf("Bad magic number for ending %#v", data[:16])
+		return fmt.Errorf("%w for ending %#v", ErrBadMagic, data[:16])
+	}
+
+	// Up to the length of the ending
+	if len(data) < 24 {
+		return fmt.Errorf("%w, only %d bytes", ErrBadEnding, len(data))
 	}
 
 	{
-		size1 := binary.LittleEndian.Uint32(data[20:24])
-		if int64(size1) > size {
-			return fmt.Errorf("Bad ending size %d", size1)
+		// A decrypted ending is shorter than the space for it
+		size1 := byteOrder(header).Uint32(data[20:24])
+		if size1 < 24 {
+			return fmt.Errorf("%w size %d, shorter than its length", ErrBadEnding, size1)
+		} else if int64(size1) > int64(len(data)) {
+			return fmt.Errorf("%w size %d, only %d bytes", ErrBadEnding, size1, len(data))
 		}
 		data = data[:size1]
 	}
 
-	return parseEntries(data, 0, result)
+	if err := parseEntries(data, 0, result, options, byteOrder(header)); err != nil {
+		return err
+	}
+	if result.EndingSize.Size != 0 && result.EndingSize.Size != blocks {
+		return fmt.Errorf("%w, gives size %d blocks, read as %d", ErrBadEnding, result.EndingSize.Size, blocks)
+	}
+	return nil
+}
+
+func ftell(f io.Seeker) (int64, error) {
+	return f.Seek(0, io.SeekCurrent)
 }
 
-func ftell(f io.Seeker) int64 {
-	n, err := f.Seek(0, io.SeekCurrent)
+// fileSize returns the size of f in bytes, leaving its position as it
+// was.
+func fileSize(f io.Seeker) (int64, error) {
+	cur, err := ftell(f)
+	if err != nil {
+		return 0, err
+	}
+	size, err := f.Seek(0, io.SeekEnd)
 	if err != nil {
-		panic("can't seek" + err.Error())
+		return 0, err
 	}
-	return n
+	_, err = f.Seek(cur, io.SeekStart)
+	return size, err
 }
 
+// ExtractedImage describes an image written by ExtractArchive.
+type ExtractedImage struct {
+	Path           string `json:"path"`
+	Index          int    `json:"index"`
+	Size           int64  `json:"size"` // logical size in bytes
+	AllocatedBytes int64  `json:"allocated_bytes"`
+	ClusterSize    int64  `json:"cluster_size"`
+	// Whether the image data is encrypted with the image cipher.
+	// Extraction doesn't decrypt it.
+	Encrypted bool `json:"encrypted"`
+	// Of the output file, in hex, if ExtractOptions.Digest is given
+	Digest     string `json:"digest,omitempty"`
+	DigestAlgo string `json:"digest_algo,omitempty"`
+	// The output already existed, and was left as it was
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// The data for ImageNames templates
 type infoExtractImage struct {
 	Index int
+	// Number of images in the archive.  Only counted if the
+	// template uses it.
+	Count int
+	// Size of the archive in bytes.  Only found if the template uses
+	// it.
+	DiskSize int64
+}
+
+// templateUses tells whether t may refer to field of the data.  The
+// data passed whole, like to printf, may be used for any field.
+func templateUses(t *template.Template, field string) bool {
+	if t == nil {
+		return false
+	}
+	for _, t := range t.Templates() {
+		if t.Tree != nil && nodeUses(t.Tree.Root, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeUses is templateUses for a node of a template.
+func nodeUses(n parse.Node, field string) bool {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, n := range n.Nodes {
+			if nodeUses(n, field) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeUses(n.Pipe, field)
+	case *parse.IfNode:
+		return nodeUses(&n.BranchNode, field)
+	case *parse.RangeNode:
+		return nodeUses(&n.BranchNode, field)
+	case *parse.WithNode:
+		return nodeUses(&n.BranchNode, field)
+	case *parse.BranchNode:
+		return nodeUses(n.Pipe, field) || nodeUses(n.List, field) || nodeUses(n.ElseList, field)
+	case *parse.TemplateNode:
+		return nodeUses(n.Pipe, field)
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if nodeUses(cmd, field) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if nodeUses(arg, field) {
+				return true
+			}
+		}
+	case *parse.FieldNode:
+		return n.Ident[0] == field
+	case *parse.VariableNode:
+		// $ is the data
+		return n.Ident[0] == "$" && (len(n.Ident) == 1 || n.Ident[1] == field)
+	case *parse.ChainNode:
+		if _, ok := n.Node.(*parse.DotNode); ok {
+			return n.Field[0] == field
+		}
+		return nodeUses(n.Node, field)
+	case *parse.DotNode:
+		return true
+	}
+	return false
+}
+
+// ImageNameFuncs are the functions available in ImageNames templates
+// parsed by ParseImageNames, besides the builtin ones like printf.
+//
+//	{{hex .Index}}    index in hex, like 1f
+//	{{pad 3 .Index}}  index padded with zeros to 3 digits, like 007
+var ImageNameFuncs = template.FuncMap{
+	"hex": func(n int) string {
+		return fmt.Sprintf("%x", n)
+	},
+	"pad": func(width int, n int) string {
+		return fmt.Sprintf("%0*d", width, n)
+	},
+}
+
+// ParseImageNames parses a template for ExtractOptions.ImageNames, with
+// ImageNameFuncs.
+func ParseImageNames(text string) (*template.Template, error) {
+	return template.New("imageNames").Funcs(ImageNameFuncs).Parse(text)
 }
 
 type qcow3Header struct {
@@ -448,21 +1160,265 @@ type qcow3Header struct {
 	HeaderLength          uint32
 }
 
-func extractImage(options *ExtractOptions, index int, end int64, header *entries.ArchiveHeaderRead, ending *entries.EndingRead) error {
-	start := BlockSize * int64(ending.Ending.Start)
+// imageGeometry is where the parts of an image are, worked out from
+// its ending.  Positions are in bytes.
+type imageGeometry struct {
+	start         int64
+	end           int64
+	clusterExp    uint8
+	l1Len         int64
+	clustersStart int64
+	// Data clusters of the image as seen by a virtual machine
+	dataClusterCount int64
+	// Indices in cluster tables are 1<<indexExp bytes
+	indexExp uint8
+}
+
+// size returns the size of the image as seen by a virtual machine.
+func (g *imageGeometry) size() int64 {
+	return g.dataClusterCount << g.clusterExp
+}
+
+// clusterIndex decodes the cluster table entry at the start of data.
+// Negative ones are unallocated.
+func (g *imageGeometry) clusterIndex(data []byte, order binary.ByteOrder) int64 {
+	if g.indexExp == 3 {
+		return int64(order.Uint64(data))
+	}
+	return int64(int32(order.Uint32(data)))
+}
+
+// checkEndingClusterSize checks an ending has the cluster size in the
+// header, which writers use for every image.  A different one is only
+// an error in strict mode, as the ending's is used anyway.
+func checkEndingClusterSize(options *ExtractOptions, header *entries.ArchiveHeaderRead, ending *entries.EndingRead) error {
+	if ending.Ending.ClusterSizeExp == header.ImageBasic.ImgClusterSizeExp {
+		return nil
+	}
+	err := fmt.Errorf("%w, cluster size exponent %d, but %d in header", ErrBadEnding,
+		ending.Ending.ClusterSizeExp, header.ImageBasic.ImgClusterSizeExp)
+	if options.Strict {
+		return err
+	}
+	Warn.Println(err)
+	return nil
+}
+
+// endingDataClusters returns the number of data clusters of the image
+// of an ending.
+func endingDataClusters(ending *entries.EndingRead) uint64 {
+	if ending.WideClusters.DataClusterCount != 0 {
+		return ending.WideClusters.DataClusterCount
+	}
+	return uint64(ending.Ending.DataClusterCount)
+}
+
+func getImageGeometry(end int64, ending *entries.EndingRead, header *entries.ArchiveHeaderRead) (*imageGeometry, error) {
+	blockExp := blockSizeExp(header)
+	start := int64(ending.Ending.Start) << blockExp
 	if start > end {
-		return errors.New("Image start is after end")
+		return nil, ErrImageStartAfterEnd
 	}
-	allocatedBytes := end - start
 
-	var dest *os.File
-	{
-		info := infoExtractImage{
-			Index: index,
+	dataClusterCount := endingDataClusters(ending)
+	indexExp := uint8(2)
+	if ending.WideClusters.DataClusterCount != 0 {
+		indexExp = 3
+	}
+	// Cluster sizes are in blocks.  The limit is on the size in
+	// bytes, as with 512 byte blocks.
+	if int(blockExp)+int(ending.Ending.ClusterSizeExp) > 9+maxClusterSizeExp {
+		return nil, badEntry{int(end), fmt.Errorf("Cluster size exponent too big %d", ending.Ending.ClusterSizeExp)}
+	}
+	clusterExp := blockExp + ending.Ending.ClusterSizeExp
+	if dataClusterCount > math.MaxInt64>>clusterExp {
+		return nil, badEntry{int(end), fmt.Errorf("Image of %d clusters too big", dataClusterCount)}
+	}
+	// The L1 table has an index for each L2 table, and is at the
+	// start of the image.
+	perL2Exp := clusterExp - indexExp
+	l1Len := int64((dataClusterCount + 1<<perL2Exp - 1) >> perL2Exp)
+	if l1Len > (end-start)>>indexExp {
+		return nil, badEntry{int(end), fmt.Errorf("L1 table for %d clusters doesn't fit in image of %d bytes", dataClusterCount, end-start)}
+	}
+
+	// Clusters are numbered from clustersStart
+	clustersStart := start + int64(ending.Ending.ClustersOffset)<<blockExp
+	if clustersStart > end {
+		return nil, badEntry{int(end), fmt.Errorf("Clusters offset %d is past end of image", ending.Ending.ClustersOffset)}
+	}
+
+	return &imageGeometry{start, end, clusterExp, l1Len, clustersStart, int64(dataClusterCount), indexExp}, nil
+}
+
+// qcow2Layout is where everything goes in a QCOW2 output, worked out
+// before anything is written.  Positions are in bytes.
+//
+// Data clusters are simply copied to output, in the same order, with
+// the L2 tables among them.  Qcow2's L2 table entries are 8 bytes each.
+// Ours are 4 bytes each, unless the image has WideClusters.  Qcow2's L2
+// tables then have half the number of entries, so 2 L2 tables are
+// written for each L2 table read.
+//
+// The generated image is not likely to be written to.  Thus to save
+// effort an empty reference count table is written, and the dirty bit
+// is set.
+type qcow2Layout struct {
+	clusterExp uint8
+	size       uint64
+	// Right after the header, if not empty
+	backingFile string
+	// Cluster 0 has the header
+	refcountTable int64
+	l1Table       int64
+	l1            []uint64
+	// Where the clusters copied from the archive start
+	clusters int64
+	// Clusters that are L2 tables in the archive, in order
+	l2AtSrc []int
+	// L2 tables written for each read
+	split int
+}
+
+const (
+	// Set on entries of clusters only used once, as all of ours are
+	qcow2Copied = 0x8000000000000000
+	// Of the version 3 header without extensions
+	qcow2HeaderLength = 104
+	// qemu refuses longer backing file names
+	qcow2MaxBackingFile = 1023
+	// Cluster sizes qemu accepts, 512B to 2MiB
+	qcow2MinClusterBits = 9
+	qcow2MaxClusterBits = 21
+	// Largest L1 table qemu accepts, in bytes
+	qcow2MaxL1Size = 32 << 20
+)
+
+func newQcow2Layout(l1Data []int64, geometry *imageGeometry, backingFile string) (*qcow2Layout, error) {
+	clusterExp, dataClusterCount := geometry.clusterExp, geometry.dataClusterCount
+	l := &qcow2Layout{
+		clusterExp:    clusterExp,
+		size:          uint64(geometry.size()),
+		backingFile:   backingFile,
+		refcountTable: 1 << clusterExp,
+		l1Table:       2 << clusterExp,
+		split:         1 << (3 - geometry.indexExp),
+	}
+	if clusterExp < qcow2MinClusterBits || clusterExp > qcow2MaxClusterBits {
+		return nil, fmt.Errorf("Cluster size 2^%d can't be used in QCOW2, must be 2^%d to 2^%d",
+			clusterExp, qcow2MinClusterBits, qcow2MaxClusterBits)
+	}
+	// Each entry of the output L1 table covers 2^(clusterExp-3)
+	// clusters
+	l1Size := int64(l.split) * int64(len(l1Data))
+	if l1Size<<(clusterExp-3) < dataClusterCount {
+		return nil, fmt.Errorf("L1 table of %d entries doesn't cover %d clusters", l1Size, dataClusterCount)
+	}
+	if 8*l1Size > qcow2MaxL1Size {
+		return nil, fmt.Errorf("L1 table of %d entries too big for QCOW2", l1Size)
+	}
+	l1ClusterCount := -(-l1Size >> (clusterExp - 3))
+	l.clusters = l.l1Table + int64(l1ClusterCount)<<clusterExp
+
+	for _, v := range l1Data {
+		if v >= 0 {
+			l.l2AtSrc = append(l.l2AtSrc, int(v))
 		}
-		var name strings.Builder
-		if err := options.ImageNames.Execute(&name, info); err != nil {
-			return err
+	}
+	sort.Ints(l.l2AtSrc)
+	for i := 1; i < len(l.l2AtSrc); i++ {
+		if l.l2AtSrc[i] == l.l2AtSrc[i-1] {
+			return nil, fmt.Errorf("L2 table at cluster %d is used more than once", l.l2AtSrc[i])
+		}
+	}
+
+	l.l1 = make([]uint64, l1Size)
+	for i, l2 := range l1Data {
+		if l2 >= 0 {
+			at := l.clusterEntry(l2)
+			for j := 0; j < l.split; j++ {
+				l.l1[l.split*i+j] = at + uint64(j)<<clusterExp
+			}
+		}
+	}
+
+	return l, nil
+}
+
+// clusterEntry returns the L1 or L2 entry for a cluster in the archive,
+// or an unallocated entry if srcCluster is negative.
+func (l *qcow2Layout) clusterEntry(srcCluster int64) uint64 {
+	if srcCluster < 0 {
+		return 0
+	}
+	// Add the space used by doubling L2 tables
+	l2Before := sort.SearchInts(l.l2AtSrc, int(srcCluster))
+	return qcow2Copied | uint64(l.clusters+(int64(l2Before*(l.split-1))+srcCluster)<<l.clusterExp)
+}
+
+// fileSize returns the size of the output, given the bytes of clusters
+// copied from the archive.
+func (l *qcow2Layout) fileSize(clusterBytes int64) int64 {
+	return l.clusters + clusterBytes + int64(len(l.l2AtSrc)*(l.split-1))<<l.clusterExp
+}
+
+func (l *qcow2Layout) header() qcow3Header {
+	h := qcow3Header{
+		Magic:                 qcow2Magic,
+		Version:               3,
+		ClusterBits:           uint32(l.clusterExp),
+		Size:                  l.size,
+		L1Size:                uint32(len(l.l1)),
+		L1TableOffset:         uint64(l.l1Table),
+		RefcountTableOffset:   uint64(l.refcountTable),
+		RefcountTableClusters: 1,
+		IncompatibleFeatures:  1, // Refcounts are inconsistent
+		HeaderLength:          qcow2HeaderLength,
+	}
+	if len(l.backingFile) != 0 {
+		h.BackingFileOffset = qcow2HeaderLength
+		h.BackingFileSize = uint32(len(l.backingFile))
+	}
+	return h
+}
+
+func extractImage(ctx context.Context, options *ExtractOptions, info infoExtractImage, end int64, header *entries.ArchiveHeaderRead, ending *entries.EndingRead, result *ExtractedImage) (err error) {
+	index := info.Index
+	geometry, err := getImageGeometry(end, ending, header)
+	if err != nil {
+		return err
+	}
+	start, clusterExp, l1Len := geometry.start, geometry.clusterExp, geometry.l1Len
+	clustersStart := geometry.clustersStart
+	allocatedBytes := end - start
+
+	*result = ExtractedImage{
+		Index:          index,
+		Size:           geometry.size(),
+		AllocatedBytes: allocatedBytes,
+		ClusterSize:    int64(1) << clusterExp,
+		Encrypted:      header.ImageBasic.ImgCipher != ImgCipherNull,
+	}
+
+	var file *os.File
+	stream := options.Stream
+	removable := false
+	var name strings.Builder
+	if err := options.ImageNames.Execute(&name, info); err != nil {
+		return err
+	}
+	if name.String() == "-" {
+		result.Path = name.String()
+		file = os.Stdout
+		stream = true
+	} else {
+		if len(options.OutputDir) != 0 {
+			if err := os.MkdirAll(options.OutputDir, 0777); err != nil {
+				return err
+			}
+			joined := filepath.Join(options.OutputDir, name.String())
+			name.Reset()
+			name.WriteString(joined)
 		}
 		var err error
 		flags := os.O_WRONLY | os.O_CREATE
@@ -471,45 +1427,162 @@ func extractImage(options *ExtractOptions, index int, end int64, header *entries
 		} else {
 			flags |= os.O_EXCL
 		}
-		if dest, err = os.OpenFile(name.String(), flags, 0666); err != nil {
+		name.WriteString(compressionExtension(options.Compression))
+		result.Path = name.String()
+		if options.DirMode != 0 {
+			if err := os.MkdirAll(filepath.Dir(name.String()), options.DirMode); err != nil {
+				return err
+			}
+		}
+		// A file overwritten is left on error, as it was there
+		// before
+		existed := false
+		if info, err := os.Stat(name.String()); err == nil {
+			existed = true
+			// Pipes and character devices can't seek, and
+			// are written to as they are
+			if info.Mode()&(os.ModeNamedPipe|os.ModeCharDevice) != 0 {
+				flags = os.O_WRONLY
+				stream = true
+			}
+		}
+		if file, err = os.OpenFile(name.String(), flags, 0666); err != nil {
+			if options.SkipExisting && os.IsExist(err) {
+				Info.Println("Skipping existing", name.String())
+				result.Skipped = true
+				return nil
+			}
 			return err
 		}
+		// Pipes and character devices can't be synced
+		syncable := false
+		// A failed close can lose what was written, so the file
+		// is only removed after closing
+		defer func() {
+			if err == nil && options.Sync && syncable {
+				err = syncOutput(file, !existed)
+			}
+			if err1 := file.Close(); err == nil {
+				err = err1
+			}
+			// Not to leave part of an image under its final
+			// name
+			if err != nil && removable {
+				os.Remove(result.Path)
+			}
+		}()
+		if info, err := file.Stat(); err == nil {
+			regular := info.Mode().IsRegular()
+			removable = regular && !existed
+			syncable = regular || isBlockDevice(file)
+		}
+	}
+	Info.Printf("Extracting image %d to %s\n", index, result.Path)
+
+	if options.CheckSdCid && isBlockDevice(file) {
+		if err := checkDestSdCid(file, header); err != nil {
+			if !options.ForceSdCid {
+				return err
+			}
+			Warn.Println("Writing anyway", err)
+		}
 	}
-	defer dest.Close()
+
+	var sink io.WriteSeeker = ctxWriteSeeker{file, ctx}
+	if stream {
+		// Everything is written in order, so skipped parts
+		// can be written as zeros
+		sink = &forwardSeeker{w: sink}
+	}
+	if options.Digest != 0 {
+		if !options.Digest.Available() {
+			return fmt.Errorf("Hash %v isn't available", options.Digest)
+		}
+		hashing := &hashingSeeker{w: sink, h: options.Digest.New()}
+		sink = hashing
+		// After closeDest, so the whole output is hashed
+		defer func() {
+			if err == nil {
+				result.Digest = hex.EncodeToString(hashing.h.Sum(nil))
+				result.DigestAlgo = options.Digest.String()
+			}
+		}()
+	}
+
+	dest, closeDest, err := compressOutput(sink, options.Compression)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := closeDest(); err == nil {
+			err = err1
+		}
+	}()
 
 	src := options.File
 	if _, err := src.Seek(start, io.SeekStart); err != nil {
 		return err
 	}
 
-	if options.Raw {
-		_, err := io.CopyN(dest, src, allocatedBytes)
+	// Copies from where src is
+	copyWorkers := options.CopyWorkers
+	if copyWorkers > threads() {
+		copyWorkers = threads()
+	}
+	copyData := func(n int64) error {
+		if copyWorkers <= 1 {
+			_, err := io.CopyN(dest, src, n)
+			return err
+		}
+		pos, err := ftell(src)
+		if err != nil {
+			return err
+		}
+		if err := parallelCopy(dest, src, pos, n, copyWorkers); err != nil {
+			return err
+		}
+		_, err = src.Seek(pos+n, io.SeekStart)
 		return err
 	}
 
-	dataClusterCount := ending.Ending.DataClusterCount
-	clusterExp := 9 + ending.Ending.ClusterSizeExp
-	allocatedClusters := (end - start + 512*int64(ending.Ending.ClustersOffset)) >> clusterExp
-	l1Start := uint64(1) << clusterExp
-	l1Data := make([]int32, -(int32(-dataClusterCount) >> (clusterExp - 2)))
-	l1ClusterCount := -(-len(l1Data) >> (clusterExp - 4))
-	regularClustersEntryOffset := 0x8000000000000000 | (l1Start + uint64(l1ClusterCount)<<clusterExp)
+	// Only the file written directly has a known size
+	preallocateOutput := func(size int64) error {
+		if !options.Preallocate || stream || options.Compression != CompressionNone {
+			return nil
+		}
+		if info, err := file.Stat(); err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		return preallocate(file, size)
+	}
+
+	if options.Raw {
+		if err := preallocateOutput(allocatedBytes); err != nil {
+			return err
+		}
+		return copyData(allocatedBytes)
+	}
+
+	allocatedClusters := (end - clustersStart) >> clusterExp
+	l1Data := make([]int64, l1Len)
 
 	loggedUnrecognized := false
-	readIndex := func(r *accountingBufReader) (result int32, err error) {
-		if err = binary.Read(r, binary.LittleEndian, &result); err != nil {
+	indexData := make([]byte, 1<<geometry.indexExp)
+	readIndex := func(r *accountingBufReader) (result int64, err error) {
+		if _, err = io.ReadFull(r, indexData); err != nil {
 			return
 		}
+		result = geometry.clusterIndex(indexData, byteOrder(header))
 		if result < 0 {
 			if result != -1 {
 				if !loggedUnrecognized {
 					loggedUnrecognized = true
-					log.Printf("Got unrecognized cluster index %d in image %d at %d\n", result, index, r.pos)
+					Warn.Printf("Got unrecognized cluster index %d in image %d at %d\n", result, index, r.pos)
 				}
 			}
 		} else {
-			if int64(result) > allocatedClusters {
-				log.Printf("Got cluster number outside of image %d in image %d at %d\n", result, index, r.pos)
+			if result >= allocatedClusters {
+				Warn.Printf("Got cluster number outside of image %d in image %d at %d\n", result, index, r.pos)
 				result = -1
 			}
 		}
@@ -517,7 +1590,7 @@ func extractImage(options *ExtractOptions, index int, end int64, header *entries
 	}
 
 	{
-		reader := newAccountingBufReader(src, 0)
+		reader := newAccountingBufReader(src, 0, options.bufferSize())
 		for i, _ := range l1Data {
 			var err error
 			l1Data[i], err = readIndex(reader)
@@ -527,148 +1600,443 @@ func extractImage(options *ExtractOptions, index int, end int64, header *entries
 		}
 	}
 
-	// Data clusters are simply copied to output.  L2 tables need
-	// some processing.  The locations of L2 tables are marked.
-
-	var l2AtSrc []int
-	for _, v := range l1Data {
-		if v >= 0 {
-			l2AtSrc = append(l2AtSrc, int(v))
+	var sums map[int64]uint32
+	if options.VerifyClusters {
+		if header.ClusterCheck.Algo == ClusterCheckNone {
+			Warn.Printf("Image %d has no cluster checksums to verify\n", index)
+		} else if sums, err = readClusterChecksums(src, l1Data, geometry, allocatedClusters, byteOrder(header)); err != nil {
+			return badEntry{int(end), err}
 		}
 	}
-	sort.Ints(l2AtSrc)
-	countL2TablesBefore := func(srcCluster int32) int {
-		return sort.SearchInts(l2AtSrc, int(srcCluster))
+	var expand *clusterDecompressor
+	if algo := header.ImgCompression.Algo; algo != ImgCompressionNone {
+		if expand, err = newClusterDecompressor(algo, clusterExp); err != nil {
+			return err
+		}
+		defer expand.close()
+	}
+	if sums != nil || expand != nil {
+		// Clusters are copied one at a time, in order, to check
+		// or expand them
+		cluster := make([]byte, 1<<clusterExp)
+		copyData = func(n int64) error {
+			pos, err := ftell(src)
+			if err != nil {
+				return err
+			}
+			for ; n >= int64(len(cluster)); n -= int64(len(cluster)) {
+				if _, err := io.ReadFull(src, cluster); err != nil {
+					return err
+				}
+				number := (pos - clustersStart) >> clusterExp
+				if sum, ok := sums[number]; ok {
+					if got, _ := computeClusterChecksum(cluster, header.ClusterCheck.Algo); got != sum {
+						return fmt.Errorf("%w of cluster %d at %d", ErrBadChecksum, number, pos)
+					}
+				}
+				out := cluster
+				if expand != nil {
+					if out, err = expand.expand(cluster); err != nil {
+						return err
+					}
+				}
+				if _, err := dest.Write(out); err != nil {
+					return err
+				}
+				pos += int64(len(cluster))
+			}
+			// A part of a cluster at the end can't be
+			// referenced
+			_, err = io.CopyN(dest, src, n)
+			return err
+		}
 	}
 
-	// Qcow2's L2 table entries are 8 bytes each.  Ours are 4 bytes
-	// each.  Qcow2's L2 tables have half the number of entries.  So
-	// 2 L2 tables are written for each L2 table read.
-
-	// The generated image is not likely to be written to.  Thus to
-	// save effort an empty reference count table is written, and
-	// the dirty bit is set.
+	var backingFile strings.Builder
+	if options.BackingFile != nil {
+		if err := options.BackingFile.Execute(&backingFile, info); err != nil {
+			return err
+		}
+		// The header must fit in the first cluster
+		if n := backingFile.Len(); n > qcow2MaxBackingFile || qcow2HeaderLength+n > 1<<clusterExp {
+			return fmt.Errorf("Backing file name too long, %d bytes", n)
+		}
+	}
+	layout, err := newQcow2Layout(l1Data, geometry, backingFile.String())
+	if err != nil {
+		return badEntry{int(end), err}
+	}
+	if err := preallocateOutput(layout.fileSize(end - clustersStart)); err != nil {
+		return err
+	}
 
-	// Write header
+	// Everything is written in order, seeking only forward
 
-	if err := binary.Write(dest, binary.BigEndian, qcow3Header{
-		Magic:                 0x514649fb,
-		Version:               3,
-		ClusterBits:           uint32(clusterExp),
-		Size:                  uint64(dataClusterCount) << clusterExp,
-		L1Size:                uint32(2 * len(l1Data)),
-		L1TableOffset:         l1Start,
-		RefcountTableOffset:   1 << clusterExp,
-		RefcountTableClusters: 1,
-		IncompatibleFeatures:  1, // Refcounts are inconsistent
-		HeaderLength:          104,
-	}); err != nil {
+	if err := binary.Write(dest, binary.BigEndian, layout.header()); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(dest, layout.backingFile); err != nil {
 		return err
 	}
 
-	// Write L1 table
-
-	writer := bufio.NewWriter(dest)
+	writer := bufio.NewWriterSize(dest, options.bufferSize())
 	defer writer.Flush()
-	if _, err := dest.Seek(int64(l1Start), io.SeekStart); err != nil {
+	if _, err := dest.Seek(layout.l1Table, io.SeekStart); err != nil {
 		return err
 	}
-	for _, l2 := range l1Data {
-		entry := make([]byte, 16)
-		if l2 < 0 {
-			// Not allocated, write zeros
-		} else {
-			// Allocated
-			// add the space used by doubling L2 tables
-			at := regularClustersEntryOffset + ((uint64(countL2TablesBefore(l2)) + uint64(l2)) << clusterExp)
-			binary.BigEndian.PutUint64(entry[0:8], at)
-			binary.BigEndian.PutUint64(entry[8:16], at+(uint64(1)<<clusterExp))
-		}
-		if _, err := writer.Write(entry); err != nil {
-			return err
-		}
+	if err := binary.Write(writer, binary.BigEndian, layout.l1); err != nil {
+		return err
 	}
 	writer.Flush()
 
 	// Write L2 table and data clusters
 
-	if _, err := dest.Seek(int64(regularClustersEntryOffset&0x7fffffffffffffff), io.SeekStart); err != nil {
+	if _, err := dest.Seek(layout.clusters, io.SeekStart); err != nil {
 		return err
 	}
-	if _, err := src.Seek(start+512*int64(ending.Ending.ClustersOffset), io.SeekStart); err != nil {
+	if _, err := src.Seek(clustersStart, io.SeekStart); err != nil {
 		return err
 	}
-	lastL2 := 0
-	for _, l2 := range l2AtSrc {
-		if _, err := io.CopyN(dest, src, int64(l2-lastL2)<<clusterExp); err != nil {
+	// The first cluster not yet copied
+	nextCluster := 0
+	// Reused for every table, so big images don't allocate a buffer
+	// for each
+	table := &io.LimitedReader{R: src}
+	reader := newAccountingBufReader(table, 0, options.bufferSize())
+	checked := header.ClusterCheck.Algo != ClusterCheckNone
+	for _, l2 := range layout.l2AtSrc {
+		if l2 < nextCluster {
+			return badEntry{int(end), fmt.Errorf("L2 table at cluster %d is in the checksums of the one before", l2)}
+		}
+		if err := copyData(int64(l2-nextCluster) << clusterExp); err != nil {
 			return err
 		}
-		lastL2 = l2
+		nextCluster = l2 + 1
 
-		reader := newAccountingBufReader(src, ftell(src)-start)
-		for i := 0; i < 1<<(clusterExp-2); i++ {
-			var entOut uint64
-			var entIn int32
+		// Limit to the table so src is left right after it
+		pos, err := ftell(src)
+		if err != nil {
+			return err
+		}
+		table.N = 1 << clusterExp
+		reader.reset(table, pos-start)
+		for i := 0; i < 1<<(clusterExp-geometry.indexExp); i++ {
 			entIn, err := readIndex(reader)
 			if err != nil {
 				return err
 			}
-			if entIn < 0 {
-				entOut = 0
-			} else {
-				entOut = regularClustersEntryOffset + ((uint64(countL2TablesBefore(entIn)) + uint64(entIn)) << clusterExp)
-			}
-			if err := binary.Write(writer, binary.BigEndian, entOut); err != nil {
+			if err := binary.Write(writer, binary.BigEndian, layout.clusterEntry(entIn)); err != nil {
 				return err
 			}
 		}
 		writer.Flush()
+
+		// The checksums after the table aren't data, so they are
+		// neither checked nor expanded, and left as zeros
+		if checked {
+			if _, err := src.Seek(1<<clusterExp, io.SeekCurrent); err != nil {
+				return err
+			}
+			if _, err := writeZeros(dest, 1<<clusterExp); err != nil {
+				return err
+			}
+			nextCluster++
+		}
+	}
+	// Copy the remaining data clusters
+	remaining := end - clustersStart - int64(nextCluster)<<clusterExp
+	if remaining < 0 {
+		return badEntry{int(end), fmt.Errorf("L2 table at cluster %d is outside of image", nextCluster-1)}
 	}
-	if _, err := io.CopyN(dest, src, allocatedBytes-(int64(lastL2)<<clusterExp)); err != nil {
+	if err := copyData(remaining); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func ExtractArchive(options *ExtractOptions) error {
-	var header entries.ArchiveHeaderRead
-	if err := readArchiveHeader(options, &header); err != nil {
-		return err
+// readClusterChecksums reads the checksum table after each L2 table of
+// an image, returning the checksums by data cluster number.  They are
+// read first, as a table may come after its data clusters.  Checksums
+// are 4 bytes whatever the size of indices.
+func readClusterChecksums(src io.ReaderAt, l1 []int64, geometry *imageGeometry, allocatedClusters int64, order binary.ByteOrder) (map[int64]uint32, error) {
+	clustersStart, clusterExp := geometry.clustersStart, geometry.clusterExp
+	indexSize := 1 << geometry.indexExp
+	sums := make(map[int64]uint32)
+	table := make([]byte, 1<<clusterExp)
+	sumTable := make([]byte, 1<<clusterExp)
+	for _, l2 := range l1 {
+		if l2 < 0 {
+			continue
+		}
+		if l2+1 >= allocatedClusters {
+			return nil, fmt.Errorf("Checksums of L2 table at cluster %d are outside of image", l2)
+		}
+		if err := readFullAt(src, table, clustersStart+l2<<clusterExp); err != nil {
+			return nil, err
+		}
+		if err := readFullAt(src, sumTable, clustersStart+(l2+1)<<clusterExp); err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(table)/indexSize; i++ {
+			number := geometry.clusterIndex(table[i*indexSize:], order)
+			if number >= 0 && number < allocatedClusters {
+				sums[number] = order.Uint32(sumTable[4*i:])
+			}
+		}
 	}
+	return sums, nil
+}
 
-	endAt := findEnd(options.File, &header)
+// walkImages follows the chain of endings from the newest image.  cb is
+// called with the index of each image, the end of its ending, and the
+// ending.  Walking stops when cb returns false.  With
+// ExtractOptions.Salvage, an image that can't be read or that cb fails
+// on is logged and skipped, and a broken link in the chain is bridged
+// with ScanForEndings.  The errors are then returned together at the
+// end.
+func walkImages(options *ExtractOptions, header *entries.ArchiveHeaderRead, cb func(index int, endAt int64, ending *entries.EndingRead) (bool, error)) error {
+	blockSize := HeaderBlockSize(header)
+	areaStart := blockSize * int64(header.ImageArea.Start)
+
+	var errs errorList
+	var scanned []foundEnding
+	scanDone := false
+	// The end and size of the newest ending found by scanning
+	// before endAt, or areaStart if there is none
+	scanBefore := func(endAt int64) (int64, uint32) {
+		if !scanDone {
+			Info.Println("Scanning for endings")
+			var err error
+			if scanned, err = scanForEndings(options, header); err != nil {
+				Warn.Println("Error scanning for endings", err)
+				errs = append(errs, err)
+			}
+			scanDone = true
+		}
+		for _, e := range scanned {
+			if e.end < endAt {
+				return e.end, e.blocks
+			}
+		}
+		return areaStart, 0
+	}
+	// Records err, and tells whether to go on
+	salvage := func(err error) bool {
+		if !options.Salvage || isContextErr(err) {
+			return false
+		}
+		Warn.Println("Skipping", err)
+		errs = append(errs, err)
+		return true
+	}
+	finish := func(err error) error {
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if len(errs) == 0 {
+			return nil
+		}
+		if !options.Salvage {
+			return errs[0]
+		}
+		return errs
+	}
+
+	// Each ending's size is known before reading it, from the end
+	// pointer or the newer ending
+	endAt, endBlocks, endErrs := findEnd(options.File, header)
 	if endAt == 0 {
-		return errors.New("No valid end pointer exists")
+		err := append(errorList{ErrNoEndPointer}, endErrs...)
+		if !salvage(err) {
+			return err
+		}
+		endAt, endBlocks = scanBefore(blockSize*int64(header.ImageArea.End) + 1)
 	}
+	Debug.Println("Newest ending ends at block", endAt/blockSize)
 
+	// A chain that loops, like with two endings whose Prev point at
+	// each other, would be walked forever.  Links not pointing
+	// backwards are caught below; this catches an ending reached
+	// again whatever the links are followed or bridged by.
+	visited := make(map[int64]bool)
 	for index := 0; ; index++ {
-		if endAt <= int64(header.ImageArea.Start) {
-			return fmt.Errorf("Image ending is outside of image area at %d", endAt)
-		} else if endAt == int64(header.ImageArea.Start) {
-			break
+		if endAt < areaStart {
+			return finish(&ImageError{index, endAt, fmt.Errorf("%w, outside of image area", ErrBadEnding)})
+		} else if endAt == areaStart {
+			return finish(nil)
 		}
+		if visited[endAt] {
+			return finish(&ImageError{index, endAt, fmt.Errorf("%w, chain of endings loops back to it", ErrBadEnding)})
+		}
+		visited[endAt] = true
 
 		var ending entries.EndingRead
-		err := readEnding(endAt, &ending, options, &header)
+		err := readEnding(endAt, endBlocks, &ending, options, header)
 		if err == errNoMoreImages {
-			break
+			return finish(nil)
+		}
+		// Only now is it known there is another image
+		if options.MaxImages != 0 && index >= options.MaxImages {
+			return finish(&ImageError{index, endAt, fmt.Errorf("%w in archive, max %d", ErrTooManyImages, options.MaxImages)})
+		}
+		if err == nil {
+			Debug.Printf("Image %d ending at blocks %d to %d: start %d, prev %d, %d data clusters\n",
+				index, (endAt-endingBytes(header, &ending))/blockSize, endAt/blockSize,
+				ending.Ending.Start, ending.Ending.Prev, endingDataClusters(&ending))
+			err = checkEndingClusterSize(options, header, &ending)
 		}
 		if err != nil {
-			return err
+			if !salvage(&ImageError{index, endAt, err}) {
+				return finish(&ImageError{index, endAt, err})
+			}
+			endAt, endBlocks = scanBefore(endAt)
+			continue
 		}
 
-		err = extractImage(options, index, endAt-BlockSize*int64(header.EndingSize.Size), &header, &ending)
-		if err != nil {
-			return fmt.Errorf("Error extracting image at %d %v", endAt, err)
+		more, err := cb(index, endAt, &ending)
+		if err != nil && !salvage(&ImageError{index, endAt, err}) {
+			return finish(&ImageError{index, endAt, err})
+		}
+		if !more {
+			return finish(nil)
 		}
 
-		endAtNext := BlockSize * int64(ending.Ending.Prev)
+		endAtNext := blockSize * int64(ending.Ending.Prev)
+		endBlocks = ending.PrevEndingSize.Size
 		if endAtNext >= endAt {
-			return fmt.Errorf("Ending does not point backwards %d at %d", endAtNext, endAt)
+			err := &ImageError{index, endAt, fmt.Errorf("%w, does not point backwards to %d", ErrBadEnding, endAtNext)}
+			if !salvage(err) {
+				return finish(err)
+			}
+			endAtNext, endBlocks = scanBefore(endAt)
+		} else if endAtNext < areaStart && options.Salvage {
+			salvage(&ImageError{index, endAt, fmt.Errorf("%w, points outside of image area to %d", ErrBadEnding, endAtNext)})
+			endAtNext, endBlocks = scanBefore(endAt)
 		}
 		endAt = endAtNext
 	}
+}
 
-	return nil
+// ExtractArchive extracts the images in the archive, and returns a
+// description of each image extracted.  An output that fails to be
+// written is removed, unless it overwrote a file.
+func ExtractArchive(options *ExtractOptions) ([]ExtractedImage, error) {
+	return ExtractArchiveContext(context.Background(), options)
+}
+
+// ExtractArchiveContext is ExtractArchive, stopping with ctx's error
+// when ctx is done.  The output being written then is removed like a
+// failed one.
+func ExtractArchiveContext(ctx context.Context, options *ExtractOptions) ([]ExtractedImage, error) {
+	var header entries.ArchiveHeaderRead
+	if err := readArchiveHeader(options, &header); err != nil {
+		return nil, err
+	}
+
+	var results []ExtractedImage
+
+	selected := options.Indices != nil || options.IndexRanges != nil
+	wanted := make(map[int]bool)
+	lastWanted := -1
+	for _, i := range options.Indices {
+		wanted[i] = true
+		if i > lastWanted {
+			lastWanted = i
+		}
+	}
+	for _, r := range options.IndexRanges {
+		if r.First <= r.Last && r.Last > lastWanted {
+			lastWanted = r.Last
+		}
+	}
+	if selected && lastWanted < 0 {
+		return results, nil
+	}
+	isWanted := func(index int) bool {
+		if !selected || wanted[index] {
+			return true
+		}
+		for _, r := range options.IndexRanges {
+			if index >= r.First && index <= r.Last {
+				return true
+			}
+		}
+		return false
+	}
+
+	info := infoExtractImage{Count: -1, DiskSize: -1}
+	if templateUses(options.ImageNames, "DiskSize") {
+		var err error
+		if info.DiskSize, err = fileSize(options.File); err != nil {
+			return nil, err
+		}
+	}
+	// Counting walks the chain an extra time
+	if templateUses(options.ImageNames, "Count") {
+		info.Count = 0
+		err := walkImages(options, &header, func(index int, endAt int64, ending *entries.EndingRead) (bool, error) {
+			info.Count++
+			return true, nil
+		})
+		if err != nil && !options.Salvage {
+			return nil, err
+		}
+	}
+
+	err := walkImages(options, &header, func(index int, endAt int64, ending *entries.EndingRead) (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		more := !selected || index < lastWanted
+		if isWanted(index) {
+			var result ExtractedImage
+			info.Index = index
+			err := extractImage(ctx, options, info, endAt-endingBytes(&header, ending), &header, ending, &result)
+			if err != nil {
+				return more, err
+			}
+			results = append(results, result)
+		}
+		return more, nil
+	})
+
+	return results, err
+}
+
+// EstimateExtractedSize returns the size in bytes of the file each
+// image would be extracted to with options, indexed like the images of
+// ExtractArchive.  Nothing is written.  Compression isn't accounted
+// for.
+func EstimateExtractedSize(options *ExtractOptions) ([]int64, error) {
+	var header entries.ArchiveHeaderRead
+	if err := readArchiveHeader(options, &header); err != nil {
+		return nil, err
+	}
+	var sizes []int64
+	err := walkImages(options, &header, func(index int, endAt int64, ending *entries.EndingRead) (bool, error) {
+		end := endAt - endingBytes(&header, ending)
+		if options.Raw {
+			geometry, err := getImageGeometry(end, ending, &header)
+			if err != nil {
+				return false, err
+			}
+			sizes = append(sizes, end-geometry.start)
+			return true, nil
+		}
+
+		// The same tables extractImage works from
+		r, err := newImageReader(options.File, end, ending, &header, byteOrder(&header))
+		if err != nil {
+			return false, err
+		}
+		layout, err := newQcow2Layout(r.l1, r.geometry, "")
+		if err != nil {
+			return false, err
+		}
+		sizes = append(sizes, layout.fileSize(end-r.clustersStart))
+		return true, nil
+	})
+
+	return sizes, err
 }
@@ -0,0 +1,680 @@
+package archive
+
+import (
+	"./entries"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// testArchive returns an archive of count small images, made like
+// TestRoundTrip makes one, and its header.
+func testArchive(t *testing.T, count int) (*os.File, *entries.ArchiveHeaderRead) {
+	t.Helper()
+	images := make([][]byte, count)
+	for i := range images {
+		images[i] = bytes.Repeat([]byte("image"), 1000)
+	}
+	return testArchiveOf(t, 3, images...)
+}
+
+// testArchiveOf returns an archive of images, appended in order, with
+// clusters of 2^clusterSizeExp blocks, and its header.
+func testArchiveOf(tb testing.TB, clusterSizeExp uint8, images ...[]byte) (*os.File, *entries.ArchiveHeaderRead) {
+	tb.Helper()
+	f, err := os.Create(filepath.Join(tb.TempDir(), "archive"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { f.Close() })
+
+	// Room for the tables and endings too
+	diskSize := int64(4 << 20)
+	for _, image := range images {
+		diskSize += 2 * int64(len(image))
+	}
+	RandReaderInit()
+	defer RandReaderClose()
+	if _, err := WriteEmptyArchive(&NewArchiveOptions{
+		Output:            f,
+		DiskSize:          diskSize,
+		GlobalLogs:        []LogConf{{Size: 1}},
+		ImgLogs:           []LogConf{{Size: 1}},
+		EndPointersHead:   1,
+		EndPointersTail:   1,
+		ImgClusterSizeExp: clusterSizeExp,
+		AlignmentBlocks:   8,
+		FillMethod:        FillSeek,
+	}); err != nil {
+		tb.Fatal(err)
+	}
+	for _, image := range images {
+		if err := AppendImage(&AppendOptions{
+			File:  f,
+			Image: bytes.NewReader(image),
+			Size:  int64(len(image)),
+		}); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	var header entries.ArchiveHeaderRead
+	if err := readArchiveHeader(&ExtractOptions{File: f}, &header); err != nil {
+		tb.Fatal(err)
+	}
+	return f, &header
+}
+
+// multiL2Image returns an image of 1MiB with every other 512 byte
+// cluster set, which takes 16 L2 tables.
+func multiL2Image() []byte {
+	image := make([]byte, 1<<20)
+	for i := 0; i < len(image); i += 1024 {
+		copy(image[i:i+512], bytes.Repeat([]byte{byte(i >> 10), 1}, 256))
+	}
+	return image
+}
+
+// countingFile counts the reads of an archive file.
+type countingFile struct {
+	ArchiveFile
+	reads int64
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	atomic.AddInt64(&f.reads, 1)
+	return f.ArchiveFile.Read(p)
+}
+
+func (f *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt64(&f.reads, 1)
+	return f.ArchiveFile.ReadAt(p, off)
+}
+
+// testEndings returns where the ending of each image in f ends, the
+// newest first.
+func testEndings(t *testing.T, f ArchiveFile, header *entries.ArchiveHeaderRead) []int64 {
+	t.Helper()
+	var ends []int64
+	if err := walkImages(&ExtractOptions{File: f}, header, func(index int, endAt int64, ending *entries.EndingRead) (bool, error) {
+		ends = append(ends, endAt)
+		return true, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return ends
+}
+
+// endPointerFile returns a file of count end pointers, one per block,
+// all pointing to block 1000.
+func endPointerFile(count int, algo uint32) (*MemFile, *entries.ArchiveHeaderRead) {
+	f := NewMemFile(nil)
+	header := &entries.ArchiveHeaderRead{}
+	header.EndPointerChec.Algo = algo
+	for i := 0; i < count; i++ {
+		f.WriteAt(makeEndPointer(1000, 0, algo, BlockSize, binary.LittleEndian), int64(i)*BlockSize)
+		header.EndPointerLoca = append(header.EndPointerLoca, entries.EndPointerLoca{Blk: uint32(i)})
+	}
+	return f, header
+}
+
+func BenchmarkVerifyEndPointer(b *testing.B) {
+	for _, algo := range []uint32{EndPointerChecksumSHA256, EndPointerChecksumCRC32} {
+		b.Run(EndPointerChecksums[algo].Name, func(b *testing.B) {
+			f, _ := endPointerFile(1, algo)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, ok, err := VerifyEndPointer(f, 0, BlockSize, algo, binary.LittleEndian); !ok || err != nil {
+					b.Fatal(ok, err)
+				}
+			}
+		})
+	}
+}
+
+// An archive with dozens of end pointers, all checked on every read
+func BenchmarkFindEnd(b *testing.B) {
+	for _, algo := range []uint32{EndPointerChecksumSHA256, EndPointerChecksumCRC32} {
+		b.Run(EndPointerChecksums[algo].Name, func(b *testing.B) {
+			f, header := endPointerFile(48, algo)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if pos, _, errs := findEnd(f, header); pos != 1000*BlockSize || errs != nil {
+					b.Fatal(pos, errs)
+				}
+			}
+		})
+	}
+}
+
+// An entry with a variable size field before a fixed size one
+type midSliceEntry struct {
+	Before uint32
+	Data   []byte
+	After  uint16
+}
+
+var idMidSliceEntry = entries.EntryTypeID{'T', 'E', 'S', 'T', '-', 'M', 'I', 'D', '-', 'S', 'L', 'I', 'C', 'E'}
+
+func init() {
+	entries.RegisterEntryType(idMidSliceEntry, midSliceEntry{})
+}
+
+func TestParseEntrySliceNotLast(t *testing.T) {
+	for _, want := range []midSliceEntry{
+		{Before: 0x01020304, Data: []byte("variable"), After: 0x0506},
+		{Before: 7, Data: []byte{0}, After: 8},
+		{Before: 7, After: 8},
+	} {
+		var buf bytes.Buffer
+		if err := writeEntry(&buf, reflect.ValueOf(want)); err != nil {
+			t.Fatal(err)
+		}
+		split, err := splitEntries(buf.Bytes(), 0, binary.LittleEndian)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(split[idMidSliceEntry]) != 1 {
+			t.Fatalf("Got entries %v", split)
+		}
+
+		var got midSliceEntry
+		if err := parseEntry(split[idMidSliceEntry][0], reflect.ValueOf(&got).Elem(), true, binary.LittleEndian); err != nil {
+			t.Fatal(err)
+		}
+		if got.Before != want.Before || got.After != want.After || !bytes.Equal(got.Data, want.Data) {
+			t.Errorf("Wrote %+v, read back %+v", want, got)
+		}
+	}
+}
+
+func TestSplitEntriesShort(t *testing.T) {
+	for _, size := range []uint32{0, 1, 19} {
+		data := make([]byte, 40)
+		copy(data, idMidSliceEntry[:])
+		binary.LittleEndian.PutUint32(data[16:], size)
+		_, err := splitEntries(data, 0, binary.LittleEndian)
+		var bad badEntry
+		if !errors.As(err, &bad) {
+			t.Errorf("Entry of %d bytes: got %v, want a badEntry", size, err)
+		}
+	}
+}
+
+func TestCheckEndPointersApart(t *testing.T) {
+	for _, c := range []struct {
+		blks      []uint32
+		increment uint32
+		ok        bool
+	}{
+		{[]uint32{8, 100}, 0, true},
+		{[]uint32{8, 9}, 0, true},
+		{[]uint32{8, 8}, 0, false},
+		{[]uint32{8, 9}, 8, false},
+		{[]uint32{8, 16}, 8, true},
+		{[]uint32{8, 100, 103}, 4, false},
+	} {
+		header := &entries.ArchiveHeaderRead{}
+		header.ImageArea = entries.ImageArea{Start: 24, End: 100}
+		header.AllocateOnce.AllocationIncrement = c.increment
+		for _, blk := range c.blks {
+			header.EndPointerLoca = append(header.EndPointerLoca, entries.EndPointerLoca{Blk: blk})
+		}
+		err := checkArchiveHeader(&ExtractOptions{}, header, BlockSize, true)
+		if c.ok && err != nil {
+			t.Errorf("End pointers %v, increment %d: %v", c.blks, c.increment, err)
+		} else if !c.ok && !errors.Is(err, ErrBadEndPointer) {
+			t.Errorf("End pointers %v, increment %d: got %v, want ErrBadEndPointer", c.blks, c.increment, err)
+		}
+	}
+}
+
+func TestWalkImagesMax(t *testing.T) {
+	f, header := testArchive(t, 2)
+	for _, c := range []struct {
+		max   int
+		count int
+		ok    bool
+	}{
+		{0, 2, true},
+		{3, 2, true},
+		{2, 2, true},
+		{1, 1, false},
+	} {
+		count := 0
+		err := walkImages(&ExtractOptions{File: f, MaxImages: c.max}, header, func(index int, endAt int64, ending *entries.EndingRead) (bool, error) {
+			count++
+			return true, nil
+		})
+		if c.ok != (err == nil) || (!c.ok && !errors.Is(err, ErrTooManyImages)) || count != c.count {
+			t.Errorf("MaxImages %d: walked %d images, error %v", c.max, count, err)
+		}
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	f, header := testArchive(t, 3)
+	ends := testEndings(t, f, header)
+	if len(ends) != 3 {
+		t.Fatalf("Got %d images, want 3", len(ends))
+	}
+
+	// The middle image's ending, so the newer one is read first
+	start := ends[1] - HeaderBlockSize(header)*int64(header.EndingSize.Size)
+	if _, err := f.WriteAt(make([]byte, 16), start); err != nil {
+		t.Fatal(err)
+	}
+	err := walkImages(&ExtractOptions{File: f}, header, func(index int, endAt int64, ending *entries.EndingRead) (bool, error) {
+		return true, nil
+	})
+	var imageErr *ImageError
+	if !errors.As(err, &imageErr) {
+		t.Fatalf("Got %v, want an ImageError", err)
+	}
+	if imageErr.Index != 1 || imageErr.Pos != ends[1] {
+		t.Errorf("Got image %d at %d, want image 1 at %d", imageErr.Index, imageErr.Pos, ends[1])
+	}
+
+	blk := header.EndPointerLoca[0].Blk
+	if _, err := f.WriteAt(make([]byte, 16), HeaderBlockSize(header)*int64(blk)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, errs := findEnd(f, header)
+	var pointerErr *EndPointerError
+	if !errors.As(errs, &pointerErr) {
+		t.Fatalf("Got %v, want an EndPointerError", errs)
+	}
+	if pointerErr.Blk != blk {
+		t.Errorf("Got end pointer at block %d, want %d", pointerErr.Blk, blk)
+	}
+}
+
+// testEndingSize writes size as the length of the newest ending in f,
+// and reads it back.
+func testEndingSize(t *testing.T, size uint32) error {
+	t.Helper()
+	f, header := testArchive(t, 1)
+	end := testEndings(t, f, header)[0]
+	start := end - HeaderBlockSize(header)*int64(header.EndingSize.Size)
+	var data [4]byte
+	binary.LittleEndian.PutUint32(data[:], size)
+	if _, err := f.WriteAt(data[:], start+20); err != nil {
+		t.Fatal(err)
+	}
+	var ending entries.EndingRead
+	return readEndingSized(end, header.EndingSize.Size, &ending, &ExtractOptions{File: f}, header)
+}
+
+func TestReadEndingShort(t *testing.T) {
+	for _, size := range []uint32{0, 16, 23} {
+		if err := testEndingSize(t, size); !errors.Is(err, ErrBadEnding) {
+			t.Errorf("Ending of %d bytes: got %v, want ErrBadEnding", size, err)
+		}
+	}
+}
+
+func TestReadEndingOversize(t *testing.T) {
+	// One past the ending, and far past it
+	for _, size := range []uint32{BlockSize + 1, 1 << 31} {
+		if err := testEndingSize(t, size); !errors.Is(err, ErrBadEnding) {
+			t.Errorf("Ending of %d bytes: got %v, want ErrBadEnding", size, err)
+		}
+	}
+
+	// Decrypted data is shorter than the space for the ending, so a
+	// length within that space can still be past the data
+	f, header := testArchive(t, 1)
+	end := testEndings(t, f, header)[0]
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, 100)
+	copy(plaintext, entries.IdEnding[:])
+	binary.LittleEndian.PutUint32(plaintext[16:], 100)
+	binary.LittleEndian.PutUint32(plaintext[20:], 200)
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &key.PublicKey, plaintext, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(ciphertext, end-BlockSize); err != nil {
+		t.Fatal(err)
+	}
+	header.EndingCipher.Algo = EndingCipherRSA
+	var ending entries.EndingRead
+	options := &ExtractOptions{File: f, PrivateKeys: []*rsa.PrivateKey{key}}
+	if err := readEndingSized(end, 1, &ending, options, header); !errors.Is(err, ErrBadEnding) {
+		t.Errorf("Ending of 200 bytes decrypted to 100: got %v, want ErrBadEnding", err)
+	}
+}
+
+func TestEndingSizeRecorded(t *testing.T) {
+	f, header := testArchive(t, 2)
+	ends := testEndings(t, f, header)
+	blockSize := HeaderBlockSize(header)
+	RandReaderInit()
+	defer RandReaderClose()
+
+	// The newest ending written again over 2 blocks, giving its size
+	var ending entries.EndingRead
+	if err := readEnding(ends[0], 0, &ending, &ExtractOptions{File: f}, header); err != nil {
+		t.Fatal(err)
+	}
+	ent := []entries.Entry{ending.Ending, ending.ImageKey, entries.EndingSize{Size: 2}}
+	ending.Ending.Length = uint32(sizeOfHeader(ent))
+	ent[0] = ending.Ending
+	var buf bytes.Buffer
+	if err := writeImageEnding(&buf, ent, EndingCipherNull, nil, 2, blockSize); err != nil {
+		t.Fatal(err)
+	}
+	start := ends[0] - blockSize*int64(header.EndingSize.Size)
+	if _, err := f.WriteAt(buf.Bytes(), start); err != nil {
+		t.Fatal(err)
+	}
+	end := start + 2*blockSize
+	pointTo := func(blocks uint32) {
+		t.Helper()
+		for _, e := range header.EndPointerLoca {
+			pointer := makeEndPointer(uint32(end/blockSize), blocks, header.EndPointerChec.Algo, blockSize, binary.LittleEndian)
+			if _, err := f.WriteAt(pointer, int64(e.Blk)*blockSize); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Read at the header's size when the end pointer doesn't give
+	// one, where only its padding is
+	pointTo(0)
+	err := walkImages(&ExtractOptions{File: f}, header, func(index int, endAt int64, ending *entries.EndingRead) (bool, error) {
+		return true, nil
+	})
+	if !errors.Is(err, ErrBadMagic) {
+		t.Errorf("Ending of 2 blocks pointed to as 1: got %v, want ErrBadMagic", err)
+	}
+
+	pointTo(2)
+	if got := testEndings(t, f, header); len(got) != 2 || got[0] != end || got[1] != ends[1] {
+		t.Fatalf("Got endings at %v, want %v", got, []int64{end, ends[1]})
+	}
+
+	// The next ending gives the size of this one
+	image := bytes.Repeat([]byte("image"), 1000)
+	if err := AppendImage(&AppendOptions{File: f, Image: bytes.NewReader(image), Size: int64(len(image))}); err != nil {
+		t.Fatal(err)
+	}
+	got := testEndings(t, f, header)
+	if len(got) != 3 || got[1] != end {
+		t.Fatalf("Got endings at %v after appending, want the second at %d", got, end)
+	}
+	var newest entries.EndingRead
+	if err := readEnding(got[0], 0, &newest, &ExtractOptions{File: f}, header); err != nil {
+		t.Fatal(err)
+	}
+	if newest.PrevEndingSize.Size != 2 {
+		t.Errorf("Appended ending gives previous size %d, want 2", newest.PrevEndingSize.Size)
+	}
+}
+
+func TestReadRawHeaderLimit(t *testing.T) {
+	// Only the first entry, declaring a header of 2MiB
+	const headerSize = 2 << 20
+	data := make([]byte, headerSize)
+	copy(data, entries.IdCvtmMagic[:])
+	binary.LittleEndian.PutUint32(data[16:20], 56)
+	binary.LittleEndian.PutUint32(data[52:56], headerSize)
+	f := NewMemFile(data)
+
+	for _, c := range []struct {
+		max uint32
+		ok  bool
+	}{
+		{0, false},
+		{headerSize - 1, false},
+		{headerSize, true},
+		{math.MaxUint32, true},
+	} {
+		raw, size, err := ReadRawHeader(f, c.max)
+		if !c.ok {
+			if !errors.Is(err, ErrHeaderTooBig) {
+				t.Errorf("Limit %d: got %v, want ErrHeaderTooBig", c.max, err)
+			}
+			continue
+		}
+		if err != nil || size != headerSize || len(raw) != headerSize {
+			t.Errorf("Limit %d: got %d bytes, size %d, error %v", c.max, len(raw), size, err)
+		}
+	}
+}
+
+func TestExtractCompressedChecksums(t *testing.T) {
+	// Clusters of 4KiB stored as zlib streams padded to a cluster,
+	// which AppendImage writes as they are
+	const clusterSize = 4096
+	want := make([]byte, 4*clusterSize)
+	for i := range want {
+		want[i] = byte(i / 100)
+	}
+	var stored []byte
+	for i := 0; i < len(want); i += clusterSize {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write(want[i : i+clusterSize])
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		stored = append(stored, buf.Bytes()...)
+		stored = append(stored, make([]byte, clusterSize-buf.Len())...)
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	RandReaderInit()
+	defer RandReaderClose()
+	if _, err := WriteEmptyArchive(&NewArchiveOptions{
+		Output:            f,
+		DiskSize:          4 << 20,
+		GlobalLogs:        []LogConf{{Size: 1}},
+		ImgLogs:           []LogConf{{Size: 1}},
+		EndPointersHead:   1,
+		EndPointersTail:   1,
+		ImgClusterSizeExp: 3,
+		AlignmentBlocks:   8,
+		FillMethod:        FillSeek,
+		ClusterChecksums:  true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendImage(&AppendOptions{File: f, Image: bytes.NewReader(stored), Size: int64(len(stored))}); err != nil {
+		t.Fatal(err)
+	}
+	var header entries.ArchiveHeaderRead
+	if err := readArchiveHeader(&ExtractOptions{File: f}, &header); err != nil {
+		t.Fatal(err)
+	}
+	header.ImgCompression.Algo = ImgCompressionZlib
+
+	for _, verify := range []bool{false, true} {
+		imageNames, err := ParseImageNames(filepath.Join(t.TempDir(), "image"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		options := &ExtractOptions{File: f, ImageNames: imageNames, VerifyClusters: verify}
+		var result ExtractedImage
+		err = walkImages(options, &header, func(index int, endAt int64, ending *entries.EndingRead) (bool, error) {
+			info := infoExtractImage{Index: index, Count: -1, DiskSize: -1}
+			return true, extractImage(context.Background(), options, info, endAt-endingBytes(&header, ending), &header, ending, &result)
+		})
+		if err != nil {
+			t.Fatalf("Verifying %v: %v", verify, err)
+		}
+		got, err := readExtractedQcow2(result.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Verifying %v: extracted image differs", verify)
+		}
+	}
+}
+
+func TestExtractKeepsFileUsable(t *testing.T) {
+	f, _ := testArchive(t, 1)
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	imageNames, err := ParseImageNames(filepath.Join(t.TempDir(), "{{.DiskSize}}-{{.Index}}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	extracted, err := ExtractArchive(&ExtractOptions{File: f, ImageNames: imageNames})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%d-0", info.Size()); len(extracted) != 1 || filepath.Base(extracted[0].Path) != want {
+		t.Errorf("Extracted %v, want one image named %s", extracted, want)
+	}
+
+	if _, err := OpenArchive(&ExtractOptions{File: f}); err != nil {
+		t.Errorf("Opening after extracting: %v", err)
+	}
+}
+
+func TestQcow2LayoutClusterBits(t *testing.T) {
+	for _, c := range []struct {
+		clusterExp uint8
+		ok         bool
+	}{
+		{8, false},
+		{qcow2MinClusterBits, true},
+		{16, true},
+		{qcow2MaxClusterBits, true},
+		{22, false},
+	} {
+		geometry := &imageGeometry{clusterExp: c.clusterExp, l1Len: 1, dataClusterCount: 1, indexExp: 2}
+		_, err := newQcow2Layout([]int64{0}, geometry, "")
+		if c.ok != (err == nil) {
+			t.Errorf("Cluster size 2^%d: got error %v", c.clusterExp, err)
+		}
+	}
+}
+
+func BenchmarkExtractBufferSize(b *testing.B) {
+	f, _ := testArchiveOf(b, 0, multiL2Image())
+	imageNames, err := ParseImageNames(filepath.Join(b.TempDir(), "image"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []int{0, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			file := &countingFile{ArchiveFile: f}
+			options := &ExtractOptions{File: file, ImageNames: imageNames, Overwrite: true, ReadBufferSize: size}
+			for i := 0; i < b.N; i++ {
+				if _, err := ExtractArchive(options); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(file.reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestByteOrderInHeader(t *testing.T) {
+	f, _ := testArchive(t, 0)
+	options := &ExtractOptions{File: f}
+	var header entries.ArchiveHeaderRead
+	if err := ReadHeader(options, &header); err != nil {
+		t.Fatal(err)
+	}
+	if options.ByteOrder != nil {
+		t.Errorf("ReadHeader set options.ByteOrder to %v", options.ByteOrder)
+	}
+	if header.ByteOrder != binary.LittleEndian {
+		t.Errorf("Got byte order %v, want little-endian", header.ByteOrder)
+	}
+}
+
+func TestEndPointerByteOrder(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		f := NewMemFile(makeEndPointer(1000, 0, EndPointerChecksumSHA256, BlockSize, order))
+		pointsTo, ok, err := VerifyEndPointer(f, 0, BlockSize, EndPointerChecksumSHA256, order)
+		if err != nil || !ok || pointsTo != 1000*BlockSize {
+			t.Errorf("%v: got %d, %v, %v", order, pointsTo, ok, err)
+		}
+	}
+}
+
+func TestWalkImagesLoop(t *testing.T) {
+	f, header := testArchive(t, 2)
+	ends := testEndings(t, f, header)
+	blockSize := HeaderBlockSize(header)
+
+	// The older ending points at the newer one, which points back
+	start := ends[1] - blockSize*int64(header.EndingSize.Size)
+	var prev [4]byte
+	binary.LittleEndian.PutUint32(prev[:], uint32(ends[0]/blockSize))
+	if _, err := f.WriteAt(prev[:], start+28); err != nil {
+		t.Fatal(err)
+	}
+	var ending entries.EndingRead
+	if err := readEnding(ends[1], 0, &ending, &ExtractOptions{File: f}, header); err != nil {
+		t.Fatal(err)
+	}
+	if int64(ending.Ending.Prev)*blockSize != ends[0] {
+		t.Fatalf("Wrote Prev %d, read %d", ends[0]/blockSize, ending.Ending.Prev)
+	}
+
+	for _, salvage := range []bool{false, true} {
+		var walked []int64
+		err := walkImages(&ExtractOptions{File: f, Salvage: salvage}, header, func(index int, endAt int64, ending *entries.EndingRead) (bool, error) {
+			walked = append(walked, endAt)
+			if len(walked) > len(ends) {
+				return false, errors.New("walked too far")
+			}
+			return true, nil
+		})
+		if !errors.Is(err, ErrBadEnding) || !reflect.DeepEqual(walked, ends) {
+			t.Errorf("Salvage %v: walked %v, error %v", salvage, walked, err)
+		}
+	}
+}
+
+func TestTemplateUses(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		uses bool
+	}{
+		{"image-{{.Index}}", false},
+		{"{{pad 3 .Index}}-of-{{.Count}}", true},
+		{"{{$.Count}}", true},
+		{"{{$i := .Index}}{{$i}}", false},
+		{`{{printf "%v" .}}`, true},
+		{`{{define "n"}}{{.Count}}{{end}}{{template "n" .}}`, true},
+		{"{{if .Index}}{{.Count}}{{end}}", true},
+		{"{{range $x := .Count}}{{end}}", true},
+		{"{{(.).Count}}", true},
+	} {
+		tmpl, err := ParseImageNames(c.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := templateUses(tmpl, "Count"); got != c.uses {
+			t.Errorf("%q: uses Count %v, want %v", c.text, got, c.uses)
+		}
+	}
+}
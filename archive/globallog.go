@@ -0,0 +1,56 @@
+package archive
+
+import (
+	"./entries"
+	"bytes"
+	"fmt"
+)
+
+// ReadGlobalLogs reads the global logs of an archive, in the order of
+// the header.  A log with a checksum in the header is checked against
+// it, giving ErrBadChecksum if it doesn't match.  The logs are then
+// returned anyway.  The private key is not needed.
+func ReadGlobalLogs(options *ExtractOptions) ([][]byte, error) {
+	var header entries.ArchiveHeaderRead
+	if err := ReadHeader(options, &header); err != nil {
+		return nil, err
+	}
+	if err := checkArchiveHeader(options, &header, header.CvtmMagic.HeaderLength, false); err != nil {
+		return nil, err
+	}
+
+	blockSize := HeaderBlockSize(&header)
+	logs := make([][]byte, len(header.GlobalLogLocat))
+	for i, e := range header.GlobalLogLocat {
+		// Logs are before the image area, which bounds what is
+		// read
+		if uint64(e.Start)+uint64(e.Count) > uint64(header.ImageArea.Start) {
+			return nil, fmt.Errorf("Global log %d at blocks %d to %d overlaps the image area",
+				i, e.Start, uint64(e.Start)+uint64(e.Count))
+		}
+		logs[i] = make([]byte, int64(e.Count)*blockSize)
+		if err := readFullAt(options.File, logs[i], int64(e.Start)*blockSize); err != nil {
+			return nil, fmt.Errorf("Reading global log %d: %w", i, err)
+		}
+	}
+
+	var errs errorList
+	for _, e := range header.GlobalLogCheck {
+		if int(e.Log) >= len(logs) {
+			errs = append(errs, fmt.Errorf("Checksum for global log %d, but archive has %d", e.Log, len(logs)))
+			continue
+		}
+		checksum, err := computeHeaderChecksum(logs[e.Log], e.Algo)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !bytes.Equal(checksum[:], e.Checksum[:]) {
+			errs = append(errs, fmt.Errorf("Global log %d has %w", e.Log, ErrBadChecksum))
+		}
+	}
+	if len(errs) != 0 {
+		return logs, errs
+	}
+	return logs, nil
+}
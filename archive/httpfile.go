@@ -0,0 +1,245 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Read at a time from an HTTPFile.  Reads of entries and
+	// cluster tables are small, so whole chunks are kept.
+	httpChunkSize = 1 << 20
+	// Chunks kept by an HTTPFile
+	httpCacheChunks = 16
+	// Tries of each request before giving up
+	httpTries = 4
+)
+
+// HTTPFile reads a file from a server supporting range requests, so an
+// image can be extracted from a big archive without downloading all of
+// it.  Recently read chunks are kept, and failed requests are tried
+// again.  It can be given as ExtractOptions.File, and used
+// concurrently with ReadAt.
+type HTTPFile struct {
+	url    string
+	client *http.Client
+	size   int64
+	pos    int64
+
+	mu sync.Mutex
+	// Most recently used last
+	cache []httpChunk
+}
+
+type httpChunk struct {
+	at   int64
+	data []byte
+}
+
+// OpenHTTPFile checks the server at url supports range requests, and
+// gets the size of the file.  client is http.DefaultClient if nil.
+func OpenHTTPFile(url string, client *http.Client) (*HTTPFile, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	f := &HTTPFile{url: url, client: client}
+	_, header, err := f.read(0, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like bytes 0-0/12345
+	contentRange := header.Get("Content-Range")
+	i := strings.LastIndexByte(contentRange, '/')
+	if i < 0 {
+		return nil, fmt.Errorf("Bad Content-Range %q", contentRange)
+	}
+	if f.size, err = strconv.ParseInt(contentRange[i+1:], 10, 64); err != nil {
+		return nil, fmt.Errorf("File size unknown, Content-Range %q", contentRange)
+	}
+	return f, nil
+}
+
+// read gets n bytes from at, trying again after errors that may not
+// last.
+func (f *HTTPFile) read(at, n int64) ([]byte, http.Header, error) {
+	var err error
+	for try := 0; try < httpTries; try++ {
+		if try != 0 {
+			Debug.Printf("Trying again to read %d bytes at %d: %v\n", n, at, err)
+			time.Sleep(time.Duration(1<<try) * 250 * time.Millisecond)
+		}
+		var data []byte
+		var header http.Header
+		var temporary bool
+		data, header, temporary, err = f.readOnce(at, n)
+		if err == nil || !temporary {
+			return data, header, err
+		}
+	}
+	return nil, nil, err
+}
+
+// readOnce makes one request for n bytes from at.  temporary is whether
+// the error may not happen again.
+func (f *HTTPFile) readOnce(at, n int64) (data []byte, header http.Header, temporary bool, err error) {
+	req, err := http.NewRequest(http.MethodGet, f.url, nil)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", at, at+n-1))
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK:
+		return nil, nil, false, errors.New("Server doesn't support range requests")
+	case resp.StatusCode >= 500:
+		return nil, nil, true, fmt.Errorf("HTTP %s", resp.Status)
+	default:
+		return nil, nil, false, fmt.Errorf("HTTP %s", resp.Status)
+	}
+
+	// A server may send another range than asked for
+	contentRange := resp.Header.Get("Content-Range")
+	first, last, err := parseContentRange(contentRange)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if first != at || last != at+n-1 {
+		return nil, nil, false, fmt.Errorf("Asked for bytes %d-%d, got Content-Range %q", at, at+n-1, contentRange)
+	}
+
+	// A connection dropped in the body is also tried again
+	data, err = ioutil.ReadAll(io.LimitReader(resp.Body, n))
+	if err != nil {
+		return nil, nil, true, err
+	}
+	if int64(len(data)) != n {
+		return nil, nil, true, fmt.Errorf("Got %d bytes at %d, asked for %d", len(data), at, n)
+	}
+	return data, resp.Header, false, nil
+}
+
+// parseContentRange returns the first and last byte positions of a
+// Content-Range like bytes 0-0/12345.
+func parseContentRange(s string) (first, last int64, err error) {
+	bad := fmt.Errorf("Bad Content-Range %q", s)
+	s = strings.TrimPrefix(s, "bytes ")
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s = s[:i]
+	}
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return 0, 0, bad
+	}
+	if first, err = strconv.ParseInt(s[:i], 10, 64); err != nil {
+		return 0, 0, bad
+	}
+	if last, err = strconv.ParseInt(s[i+1:], 10, 64); err != nil {
+		return 0, 0, bad
+	}
+	return first, last, nil
+}
+
+// chunk returns the chunk starting at at, from the cache if it is
+// there.
+func (f *HTTPFile) chunk(at int64) ([]byte, error) {
+	f.mu.Lock()
+	for i, c := range f.cache {
+		if c.at == at {
+			copy(f.cache[i:], f.cache[i+1:])
+			f.cache[len(f.cache)-1] = c
+			f.mu.Unlock()
+			return c.data, nil
+		}
+	}
+	f.mu.Unlock()
+
+	n := int64(httpChunkSize)
+	if rest := f.size - at; rest < n {
+		n = rest
+	}
+	data, _, err := f.read(at, n)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	if len(f.cache) == httpCacheChunks {
+		f.cache = append(f.cache[:0], f.cache[1:]...)
+	}
+	f.cache = append(f.cache, httpChunk{at, data})
+	f.mu.Unlock()
+	return data, nil
+}
+
+func (f *HTTPFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	done := 0
+	for done < len(p) {
+		if off >= f.size {
+			return done, io.EOF
+		}
+		at := off - off%httpChunkSize
+		data, err := f.chunk(at)
+		if err != nil {
+			return done, err
+		}
+		n := copy(p[done:], data[off-at:])
+		done += n
+		off += int64(n)
+	}
+	return done, nil
+}
+
+func (f *HTTPFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *HTTPFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		break
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, fmt.Errorf("Unsupported seek whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("Seek to negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Size returns the size of the file in bytes.
+func (f *HTTPFile) Size() int64 {
+	return f.size
+}
+
+// Close drops the cache and idle connections.
+func (f *HTTPFile) Close() error {
+	f.mu.Lock()
+	f.cache = nil
+	f.mu.Unlock()
+	f.client.CloseIdleConnections()
+	return nil
+}
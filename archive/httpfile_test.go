@@ -0,0 +1,64 @@
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPFileReadAt(t *testing.T) {
+	data := bytes.Repeat([]byte("archive"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "archive", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	f, err := OpenHTTPFile(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.Size() != int64(len(data)) {
+		t.Errorf("Got size %d, want %d", f.Size(), len(data))
+	}
+	p := make([]byte, 100)
+	if _, err := f.ReadAt(p, 1234); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, data[1234:1334]) {
+		t.Errorf("Read %q, want %q", p, data[1234:1334])
+	}
+}
+
+func TestHTTPFileWrongRange(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Always the first 10 bytes, whatever is asked for
+		if atomic.AddInt32(&requests, 1) > 1 {
+			w.Header().Set("Content-Range", "bytes 0-9/100")
+		} else {
+			w.Header().Set("Content-Range", "bytes 0-0/100")
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, strings.Repeat("x", 10))
+	}))
+	defer server.Close()
+
+	f, err := OpenHTTPFile(server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.ReadAt(make([]byte, 10), 50); err == nil || !strings.Contains(err.Error(), "Content-Range") {
+		t.Errorf("Got %v, want an error about the Content-Range", err)
+	}
+	// Asking again would get the same range
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Made %d requests, want 2", n)
+	}
+}
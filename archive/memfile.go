@@ -0,0 +1,93 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MemFile is a file in memory.  An archive can be written to it with
+// WriteEmptyArchive, and it can be given as ExtractOptions.File, so
+// archives can be made and read without touching disk.
+type MemFile struct {
+	data []byte
+	pos  int64
+}
+
+// NewMemFile returns a MemFile with data as its contents.  data is used
+// directly, not copied.
+func NewMemFile(data []byte) *MemFile {
+	return &MemFile{data: data}
+}
+
+// Bytes returns the contents, which are valid until the next write.
+func (f *MemFile) Bytes() []byte {
+	return f.data
+}
+
+func (f *MemFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *MemFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *MemFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+// WriteAt extends the contents as needed, filling any gap with zeros.
+func (f *MemFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		if end > int64(cap(f.data)) {
+			data := make([]byte, end, 2*end)
+			copy(data, f.data)
+			f.data = data
+		} else {
+			// The spare capacity may hold old bytes
+			oldLen := int64(len(f.data))
+			f.data = f.data[:end]
+			for i := oldLen; i < off; i++ {
+				f.data[i] = 0
+			}
+		}
+	}
+	return copy(f.data[off:], p), nil
+}
+
+// Seek can go past the end.  The contents are only extended by writing.
+func (f *MemFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		break
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	default:
+		return 0, fmt.Errorf("Unsupported seek whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("Seek to negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
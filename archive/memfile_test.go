@@ -0,0 +1,27 @@
+package archive
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemFileGapZeros(t *testing.T) {
+	// A reused buffer, with old bytes past its length
+	buf := bytes.Repeat([]byte{0xff}, 64)
+	f := NewMemFile(buf[:4])
+	if _, err := f.WriteAt([]byte{1, 2}, 10); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 1, 2}
+	if got := f.Bytes(); !bytes.Equal(got, want) {
+		t.Errorf("Got %x, want %x", got, want)
+	}
+
+	// Growing past the capacity
+	if _, err := f.WriteAt([]byte{3}, 100); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.Bytes(); len(got) != 101 || !isZero(got[12:100]) || got[100] != 3 {
+		t.Errorf("Got %x", got)
+	}
+}
@@ -0,0 +1,57 @@
+package archive
+
+import (
+	"io"
+)
+
+// Read by each worker of parallelCopy at a time
+const parallelCopyChunk = 1 << 20
+
+type copyChunk struct {
+	buf []byte
+	err error
+}
+
+// parallelCopy copies n bytes of src from off to w.  Up to workers
+// chunks are read at once with ReadAt, and written in order, so reading
+// from fast storage isn't limited to one request at a time.
+func parallelCopy(w io.Writer, src io.ReaderAt, off, n int64, workers int) error {
+	quit := make(chan struct{})
+	// Results in the order to write them
+	pending := make(chan chan copyChunk, workers)
+	go func() {
+		defer close(pending)
+		for pos := int64(0); pos < n; pos += parallelCopyChunk {
+			size := n - pos
+			if size > parallelCopyChunk {
+				size = parallelCopyChunk
+			}
+			result := make(chan copyChunk, 1)
+			select {
+			case pending <- result:
+			case <-quit:
+				return
+			}
+			go func(at int64, size int64) {
+				buf := make([]byte, size)
+				result <- copyChunk{buf, readFullAt(src, buf, at)}
+			}(off+pos, size)
+		}
+	}()
+
+	var err error
+	for result := range pending {
+		chunk := <-result
+		if err != nil {
+			// Waiting for the reads still going
+			continue
+		}
+		if err = chunk.err; err == nil {
+			_, err = w.Write(chunk.buf)
+		}
+		if err != nil {
+			close(quit)
+		}
+	}
+	return err
+}
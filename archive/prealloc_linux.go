@@ -0,0 +1,16 @@
+package archive
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate allocates size bytes for f, extending it if needed.
+// Filesystems without fallocate get the size set instead.
+func preallocate(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP {
+		return f.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package archive
+
+import (
+	"os"
+)
+
+// preallocate can only set the size of f on this platform.
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
@@ -0,0 +1,64 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const qcow2Magic = 0x514649fb // "QFI\xfb"
+
+// Of the version 2 header, which ends before IncompatibleFeatures
+const qcow2V2HeaderLength = 72
+
+// readQcow2Header reads and checks the header of a QCOW2 image.  Fields
+// are big-endian.  Version 2 headers are accepted, with the fields only
+// in version 3 set to what they mean for version 2.
+func readQcow2Header(r io.Reader) (*qcow3Header, error) {
+	data := make([]byte, qcow2HeaderLength)
+	if _, err := io.ReadFull(r, data[:qcow2V2HeaderLength]); err != nil {
+		return nil, fmt.Errorf("Reading QCOW2 header: %w", err)
+	}
+
+	if magic := binary.BigEndian.Uint32(data[0:4]); magic != qcow2Magic {
+		if binary.LittleEndian.Uint32(data[0:4]) == qcow2Magic {
+			// Written with the wrong byte order
+			return nil, fmt.Errorf("%w for QCOW2 %#x, little-endian", ErrBadMagic, magic)
+		}
+		return nil, fmt.Errorf("%w for QCOW2 %#x", ErrBadMagic, magic)
+	}
+
+	version := binary.BigEndian.Uint32(data[4:8])
+	switch version {
+	case 2:
+		break
+	case 3:
+		if _, err := io.ReadFull(r, data[qcow2V2HeaderLength:]); err != nil {
+			return nil, fmt.Errorf("Reading QCOW2 header: %w", err)
+		}
+	default:
+		// Version 1 has a different layout altogether
+		return nil, fmt.Errorf("%w, version %d", ErrUnsupportedQcow2, version)
+	}
+
+	var header qcow3Header
+	if err := binary.Read(bytes.NewReader(data), binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if version == 2 {
+		header.RefcountOrder = 4
+		header.HeaderLength = qcow2V2HeaderLength
+	} else if header.HeaderLength < qcow2HeaderLength {
+		return nil, fmt.Errorf("%w, header length %d", ErrUnsupportedQcow2, header.HeaderLength)
+	}
+
+	if header.ClusterBits < qcow2MinClusterBits || header.ClusterBits > qcow2MaxClusterBits {
+		return nil, fmt.Errorf("%w, cluster bits %d", ErrUnsupportedQcow2, header.ClusterBits)
+	}
+	if header.CryptMethod != 0 {
+		return nil, fmt.Errorf("%w, encrypted", ErrUnsupportedQcow2)
+	}
+
+	return &header, nil
+}
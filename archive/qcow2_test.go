@@ -0,0 +1,79 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// qcow2HeaderBytes returns header as written with order.  A version 2
+// header is cut short before the fields only in version 3.
+func qcow2HeaderBytes(t *testing.T, header qcow3Header, order binary.ByteOrder) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, order, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Version == 2 {
+		return buf.Bytes()[:qcow2V2HeaderLength]
+	}
+	return buf.Bytes()
+}
+
+func testQcow2Header() qcow3Header {
+	return qcow3Header{
+		Magic:         qcow2Magic,
+		Version:       3,
+		ClusterBits:   16,
+		Size:          1 << 30,
+		L1Size:        8,
+		L1TableOffset: 2 << 16,
+		RefcountOrder: 4,
+		HeaderLength:  qcow2HeaderLength,
+	}
+}
+
+func TestReadQcow2Header(t *testing.T) {
+	for _, version := range []uint32{2, 3} {
+		want := testQcow2Header()
+		want.Version = version
+		got, err := readQcow2Header(bytes.NewReader(qcow2HeaderBytes(t, want, binary.BigEndian)))
+		if err != nil {
+			t.Fatalf("Version %d: %v", version, err)
+		}
+		if version == 2 {
+			want.HeaderLength = qcow2V2HeaderLength
+		}
+		if *got != want {
+			t.Errorf("Version %d: wrote %+v, read %+v", version, want, *got)
+		}
+	}
+}
+
+func TestReadQcow2HeaderRejects(t *testing.T) {
+	littleEndian := qcow2HeaderBytes(t, testQcow2Header(), binary.LittleEndian)
+	version1 := testQcow2Header()
+	version1.Version = 1
+	encrypted := testQcow2Header()
+	encrypted.CryptMethod = 1
+
+	for _, c := range []struct {
+		name string
+		data []byte
+		want error
+		// In the message too
+		detail string
+	}{
+		{"little-endian", littleEndian, ErrBadMagic, "little-endian"},
+		{"not QCOW2", make([]byte, qcow2HeaderLength), ErrBadMagic, ""},
+		{"version 1", qcow2HeaderBytes(t, version1, binary.BigEndian), ErrUnsupportedQcow2, "version 1"},
+		{"encrypted", qcow2HeaderBytes(t, encrypted, binary.BigEndian), ErrUnsupportedQcow2, "encrypted"},
+	} {
+		_, err := readQcow2Header(bytes.NewReader(c.data))
+		if !errors.Is(err, c.want) || !strings.Contains(err.Error(), c.detail) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+	}
+}
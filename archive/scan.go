@@ -0,0 +1,198 @@
+package archive
+
+import (
+	"./entries"
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Read at a time when scanning.  A multiple of every block size.
+const scanChunkSize = 1 << 20
+
+// ScanForEndings finds the endings of images by reading every block of
+// the image area, for when the end pointers are lost.  It returns the
+// position of the end of each ending found, as walked from an end
+// pointer, newest first.  With the RSA ending cipher every block has to
+// be decrypted, which is slow.
+func ScanForEndings(options *ExtractOptions) ([]int64, error) {
+	var header entries.ArchiveHeaderRead
+	if err := readArchiveHeader(options, &header); err != nil {
+		return nil, err
+	}
+	found, err := scanForEndings(options, &header)
+	if err != nil {
+		return nil, err
+	}
+	ends := make([]int64, len(found))
+	for i, e := range found {
+		ends[i] = e.end
+	}
+	return ends, nil
+}
+
+// foundEnding is an ending found by scanning: where it ends, and its
+// size in blocks, 0 if it is the header's.
+type foundEnding struct {
+	end    int64
+	blocks uint32
+}
+
+func scanForEndings(options *ExtractOptions, header *entries.ArchiveHeaderRead) ([]foundEnding, error) {
+	blockExp := blockSizeExp(header)
+	blockSize := int64(1) << blockExp
+	endingBytes := blockSize * int64(header.EndingSize.Size)
+	areaStart := int64(header.ImageArea.Start) << blockExp
+	areaEnd := int64(header.ImageArea.End) << blockExp
+	// Plaintext endings can be told by their magic number without
+	// parsing them
+	plaintext := header.EndingCipher.Algo == EndingCipherNull
+
+	var found []foundEnding
+	buf := make([]byte, scanChunkSize)
+	for chunkAt := areaStart; chunkAt < areaEnd; chunkAt += int64(len(buf)) {
+		chunk := buf
+		if rest := areaEnd - chunkAt; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		if plaintext {
+			if err := readFullAt(options.File, chunk, chunkAt); err != nil {
+				return nil, err
+			}
+		}
+
+		for off := int64(0); off < int64(len(chunk)); off += blockSize {
+			if plaintext && !bytes.Equal(chunk[off:off+16], entries.IdEnding[:]) {
+				continue
+			}
+			start := chunkAt + off
+			end := start + endingBytes
+			if end > areaEnd {
+				break
+			}
+
+			// The start is known, so an ending giving its own
+			// size is read again at that size
+			var ending entries.EndingRead
+			if err := readEndingSized(end, header.EndingSize.Size, &ending, options, header); err != nil {
+				blocks := ending.EndingSize.Size
+				if blocks == 0 || blocks == header.EndingSize.Size || blocks > maxEndingSize {
+					continue
+				}
+				end = start + blockSize*int64(blocks)
+				if end > areaEnd {
+					continue
+				}
+				ending = entries.EndingRead{}
+				if err := readEndingSized(end, blocks, &ending, options, header); err != nil {
+					continue
+				}
+			}
+			// Random data can look like an ending, so the
+			// image must make sense too
+			if int64(ending.Ending.Start)<<blockExp < areaStart {
+				continue
+			}
+			if _, err := getImageGeometry(start, &ending, header); err != nil {
+				continue
+			}
+			found = append(found, foundEnding{end, ending.EndingSize.Size})
+		}
+	}
+
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found, nil
+}
+
+// RepairEndPointers points every end pointer of the archive in f to the
+// newest ending found by ScanForEndings, with checksums of the header's
+// algorithm.  It is for when the end pointers are damaged but the
+// endings aren't.  privateKey is only needed with the RSA ending
+// cipher.
+func RepairEndPointers(f *os.File, privateKey *rsa.PrivateKey) error {
+	options := &ExtractOptions{File: f}
+	if privateKey != nil {
+		options.PrivateKeys = []*rsa.PrivateKey{privateKey}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var header entries.ArchiveHeaderRead
+	if err := readArchiveHeader(options, &header); err != nil {
+		return err
+	}
+
+	found, err := scanForEndings(options, &header)
+	if err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("%w, no ending found in image area", ErrBadEnding)
+	}
+	blockExp := blockSizeExp(&header)
+	Info.Println("Newest ending ends at block", found[0].end>>blockExp)
+
+	// One at a time, as when appending, so some are good if this is
+	// interrupted
+	endPointer := makeEndPointer(uint32(found[0].end>>blockExp), found[0].blocks,
+		header.EndPointerChec.Algo, int64(1)<<blockExp, byteOrder(&header))
+	for _, e := range header.EndPointerLoca {
+		if _, err := f.WriteAt(endPointer, int64(e.Blk)<<blockExp); err != nil {
+			return &EndPointerError{e.Blk, err}
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindHeader searches the first limit bytes of options.File for an
+// archive header, for an archive stored after junk or with its start
+// damaged.  It returns the position of the first header that can be
+// read.  The archive is then read from there, like through an
+// io.SectionReader, as all positions in it are relative to its start.
+func FindHeader(options *ExtractOptions, limit int64) (int64, error) {
+	magic := entries.IdCvtmMagic[:]
+	// Chunks overlap, so a magic number across two is found
+	buf := make([]byte, scanChunkSize+len(magic)-1)
+	lastErr := ErrBadMagic
+	for chunkAt := int64(0); chunkAt < limit; chunkAt += scanChunkSize {
+		n, err := options.File.ReadAt(buf, chunkAt)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		chunk := buf[:n]
+
+		for off := 0; ; off++ {
+			i := bytes.Index(chunk[off:], magic)
+			if i < 0 {
+				break
+			}
+			off += i
+			pos := chunkAt + int64(off)
+			if off >= scanChunkSize || pos >= limit {
+				break
+			}
+
+			at := *options
+			at.File = io.NewSectionReader(options.File, pos, math.MaxInt64-pos)
+			var header entries.ArchiveHeaderRead
+			if err := ReadHeader(&at, &header); err != nil {
+				lastErr = err
+				continue
+			}
+			return pos, nil
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	return 0, fmt.Errorf("No archive header in the first %d bytes: %w", limit, lastErr)
+}
@@ -0,0 +1,103 @@
+package archive
+
+import (
+	"./entries"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrSdCidMismatch = errors.New("SD card CID doesn't match")
+
+// SdCidFields are the fields of an SD card's CID register.
+type SdCidFields struct {
+	ManufacturerID uint8
+	OEMID          string
+	ProductName    string
+	RevisionMajor  uint8
+	RevisionMinor  uint8
+	SerialNumber   uint32
+	Year           int
+	Month          int
+}
+
+// DecodeSdCid decodes the CID without its last byte, which has the
+// CRC.
+func DecodeSdCid(cid [15]byte) SdCidFields {
+	return SdCidFields{
+		ManufacturerID: cid[0],
+		OEMID:          string(cid[1:3]),
+		ProductName:    string(cid[3:8]),
+		RevisionMajor:  cid[8] >> 4,
+		RevisionMinor:  cid[8] & 0xf,
+		SerialNumber:   uint32(cid[9])<<24 | uint32(cid[10])<<16 | uint32(cid[11])<<8 | uint32(cid[12]),
+		// The year is from 2000, across a byte boundary
+		Year:  2000 + int(cid[13]&0xf)<<4 + int(cid[14]>>4),
+		Month: int(cid[14] & 0xf),
+	}
+}
+
+func (c SdCidFields) String() string {
+	return fmt.Sprintf("manufacturer %#02x, OEM %q, product %q, revision %d.%d, serial %#08x, made %04d-%02d",
+		c.ManufacturerID, c.OEMID, c.ProductName, c.RevisionMajor,
+		c.RevisionMinor, c.SerialNumber, c.Year, c.Month)
+}
+
+// ParseSdCid parses a CID in hex, as in sysfs.  The CRC byte may be
+// left out.  If it is given, it is checked.
+func ParseSdCid(s string) (cid [15]byte, err error) {
+	data, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return cid, fmt.Errorf("Bad SD card CID %v", err)
+	}
+	switch len(data) {
+	case 15:
+	case 16:
+		if want := crc7(data[:15])<<1 | 1; data[15] != want {
+			return cid, fmt.Errorf("SD card CID has bad CRC %#02x, expected %#02x", data[15], want)
+		}
+	default:
+		return cid, fmt.Errorf("SD card CID is %d bytes, expected 15 or 16", len(data))
+	}
+	copy(cid[:], data)
+	return cid, nil
+}
+
+// crc7 computes the CRC used by SD cards, with polynomial x^7 + x^3 + 1.
+func crc7(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			bit := (b>>uint(i))&1 ^ crc>>6
+			crc = (crc << 1) & 0x7f
+			if bit != 0 {
+				crc ^= 0x09
+			}
+		}
+	}
+	return crc
+}
+
+// checkDestSdCid checks dest is the SD card recorded in the header.
+func checkDestSdCid(dest *os.File, header *entries.ArchiveHeaderRead) error {
+	if header.SdCid.SdCid == [15]byte{} {
+		return fmt.Errorf("%w, archive has no SD card CID", ErrSdCidMismatch)
+	}
+	cid, err := ReadDeviceSdCid(dest)
+	if err != nil {
+		return err
+	}
+	return checkSdCid(cid, header.SdCid.SdCid)
+}
+
+// checkSdCid checks the SD card CID read from a device.
+func checkSdCid(got, want [15]byte) error {
+	if !bytes.Equal(got[:], want[:]) {
+		return fmt.Errorf("%w, card has %s, expected %s", ErrSdCidMismatch,
+			DecodeSdCid(got), DecodeSdCid(want))
+	}
+	return nil
+}
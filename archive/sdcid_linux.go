@@ -0,0 +1,40 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+)
+
+// ReadDeviceSdCid reads the CID of the SD card f is, or a partition of,
+// from sysfs.
+func ReadDeviceSdCid(f *os.File) (cid [15]byte, err error) {
+	info, err := f.Stat()
+	if err != nil {
+		return cid, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !isBlockDevice(f) {
+		return cid, errors.New("Not a block device, can't read SD card CID")
+	}
+
+	rdev := uint64(stat.Rdev)
+	major := (rdev>>8)&0xfff | (rdev>>32)&^0xfff
+	minor := rdev&0xff | (rdev>>12)&^0xff
+	dir := fmt.Sprintf("/sys/dev/block/%d:%d", major, minor)
+
+	// A partition's device is its disk's
+	data, err := ioutil.ReadFile(dir + "/device/cid")
+	if os.IsNotExist(err) {
+		data, err = ioutil.ReadFile(dir + "/../device/cid")
+	}
+	if os.IsNotExist(err) {
+		return cid, errors.New("Not an SD card, no CID in sysfs")
+	} else if err != nil {
+		return cid, err
+	}
+
+	return ParseSdCid(string(data))
+}
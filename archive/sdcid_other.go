@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package archive
+
+import (
+	"errors"
+	"os"
+)
+
+func ReadDeviceSdCid(f *os.File) (cid [15]byte, err error) {
+	return cid, errors.New("Reading SD card CID is not supported on this platform")
+}
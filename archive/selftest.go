@@ -0,0 +1,145 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+)
+
+// TestRoundTrip creates an archive in a temporary directory in dir,
+// appends a generated image to it, extracts it, and checks the result
+// has the same contents.  It goes through WriteEmptyArchive, AppendImage
+// and ExtractArchive together, so it can check a build in the field.
+// RandReaderInit must have been called.
+func TestRoundTrip(dir string) error {
+	tmp, err := ioutil.TempDir(dir, "cvtm-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	// Random clusters among zero ones, and a size that isn't a
+	// whole number of clusters
+	const clusterExp = 12
+	image := make([]byte, 300<<clusterExp+123)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < len(image); i += 1 << clusterExp {
+		if r.Intn(3) == 0 {
+			r.Read(image[i:])
+		}
+	}
+
+	name := filepath.Join(tmp, "archive")
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := WriteEmptyArchive(&NewArchiveOptions{
+		Output:            f,
+		DiskSize:          4 << 20,
+		GlobalLogs:        []LogConf{{Size: 1}},
+		ImgLogs:           []LogConf{{Size: 1}},
+		EndPointersHead:   1,
+		EndPointersTail:   1,
+		ImgClusterSizeExp: clusterExp - 9,
+		AlignmentBlocks:   8,
+		FillMethod:        FillSeek,
+	}); err != nil {
+		return fmt.Errorf("Creating archive: %w", err)
+	}
+	if err := AppendImage(&AppendOptions{
+		File:  f,
+		Image: bytes.NewReader(image),
+		Size:  int64(len(image)),
+	}); err != nil {
+		return fmt.Errorf("Appending image: %w", err)
+	}
+
+	imageNames, err := ParseImageNames(filepath.Join(tmp, "image-{{.Index}}"))
+	if err != nil {
+		return err
+	}
+	extracted, err := ExtractArchive(&ExtractOptions{
+		File:       f,
+		ImageNames: imageNames,
+		Strict:     true,
+	})
+	if err != nil {
+		return fmt.Errorf("Extracting: %w", err)
+	}
+	if len(extracted) != 1 {
+		return fmt.Errorf("Extracted %d images, expected 1", len(extracted))
+	}
+
+	got, err := readExtractedQcow2(extracted[0].Path)
+	if err != nil {
+		return err
+	}
+	if len(got) < len(image) || !bytes.Equal(got[:len(image)], image) ||
+		!bytes.Equal(got[len(image):], make([]byte, len(got)-len(image))) {
+		return fmt.Errorf("Extracted image differs from the one appended")
+	}
+
+	return nil
+}
+
+// readExtractedQcow2 reads the contents of a QCOW2 image as written by
+// extractImage.  Only what it uses is supported.
+func readExtractedQcow2(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := readQcow2Header(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// Offsets in table entries are in bits 9 to 55
+	const offsetMask = 0x00fffffffffffe00
+	clusterSize := uint64(1) << header.ClusterBits
+	perL2 := clusterSize / 8
+	at := func(pos uint64, size uint64) ([]byte, error) {
+		if pos > uint64(len(data)) || size > uint64(len(data))-pos {
+			return nil, fmt.Errorf("QCOW2 refers to %d past its end", pos)
+		}
+		return data[pos : pos+size], nil
+	}
+
+	result := make([]byte, header.Size)
+	for n := uint64(0); n*clusterSize < header.Size; n++ {
+		if n/perL2 >= uint64(header.L1Size) {
+			return nil, fmt.Errorf("QCOW2 L1 table too small")
+		}
+		l1Entry, err := at(header.L1TableOffset+8*(n/perL2), 8)
+		if err != nil {
+			return nil, err
+		}
+		l2 := binary.BigEndian.Uint64(l1Entry) & offsetMask
+		if l2 == 0 {
+			continue
+		}
+		l2Entry, err := at(l2+8*(n%perL2), 8)
+		if err != nil {
+			return nil, err
+		}
+		cluster := binary.BigEndian.Uint64(l2Entry) & offsetMask
+		if cluster == 0 {
+			continue
+		}
+		clusterData, err := at(cluster, clusterSize)
+		if err != nil {
+			return nil, err
+		}
+		copy(result[n*clusterSize:], clusterData)
+	}
+
+	return result, nil
+}
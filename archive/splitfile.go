@@ -0,0 +1,225 @@
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// SplitFile is a file split into parts of the same size, named like
+// archive.001, archive.002, so an archive can be bigger than a file
+// system allows a file to be.  Every part but the last is full.  It can
+// be given as NewArchiveOptions.Output or ExtractOptions.File.
+type SplitFile struct {
+	name     string
+	partSize int64
+	parts    []*os.File
+	// Parts are created when written to
+	create bool
+	pos    int64
+}
+
+// SplitPartName returns the name of part i, counting from 0, of the
+// split file name.
+func SplitPartName(name string, i int) string {
+	return fmt.Sprintf("%s.%03d", name, i+1)
+}
+
+// OpenSplitFile opens the parts of a split file for reading.  The part
+// size is that of the first part.
+func OpenSplitFile(name string) (*SplitFile, error) {
+	f := &SplitFile{name: name}
+	for i := 0; ; i++ {
+		part, err := os.Open(SplitPartName(name, i))
+		if os.IsNotExist(err) && i != 0 {
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.parts = append(f.parts, part)
+	}
+
+	for i, part := range f.parts {
+		info, err := part.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if i == 0 {
+			f.partSize = info.Size()
+			if f.partSize == 0 {
+				f.Close()
+				return nil, fmt.Errorf("First part %s is empty", part.Name())
+			}
+		} else if info.Size() > f.partSize || (i != len(f.parts)-1 && info.Size() != f.partSize) {
+			f.Close()
+			return nil, fmt.Errorf("Part %s is %d bytes, but parts are %d", part.Name(), info.Size(), f.partSize)
+		}
+	}
+
+	return f, nil
+}
+
+// CreateSplitFile makes a split file with parts of partSize bytes.
+// Parts are created as they are written to.  Existing parts are
+// written over, not truncated, so they can be read to resume.
+func CreateSplitFile(name string, partSize int64) (*SplitFile, error) {
+	if partSize <= 0 {
+		return nil, fmt.Errorf("Bad part size %d", partSize)
+	}
+	return &SplitFile{name: name, partSize: partSize, create: true}, nil
+}
+
+// part returns part i, creating it and those before it if needed.
+// Parts before a new one are extended to the part size, so what wasn't
+// written reads as zeros.
+func (f *SplitFile) part(i int) (*os.File, error) {
+	for len(f.parts) <= i {
+		if !f.create {
+			return nil, errors.New("Split file is read only")
+		}
+		if n := len(f.parts); n != 0 {
+			last := f.parts[n-1]
+			info, err := last.Stat()
+			if err != nil {
+				return nil, err
+			}
+			if info.Size() < f.partSize {
+				if err := last.Truncate(f.partSize); err != nil {
+					return nil, err
+				}
+			}
+		}
+		part, err := os.OpenFile(SplitPartName(f.name, len(f.parts)), os.O_RDWR|os.O_CREATE, 0666)
+		if err != nil {
+			return nil, err
+		}
+		f.parts = append(f.parts, part)
+	}
+	return f.parts[i], nil
+}
+
+func (f *SplitFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *SplitFile) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	done := 0
+	for done < len(p) {
+		i := off / f.partSize
+		if i >= int64(len(f.parts)) {
+			return done, io.EOF
+		}
+		inPart := off % f.partSize
+		chunk := p[done:]
+		if rest := f.partSize - inPart; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		n, err := f.parts[i].ReadAt(chunk, inPart)
+		done += n
+		off += int64(n)
+		if n < len(chunk) {
+			if err == nil {
+				err = io.EOF
+			}
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+func (f *SplitFile) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *SplitFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset")
+	}
+	done := 0
+	for done < len(p) {
+		part, err := f.part(int(off / f.partSize))
+		if err != nil {
+			return done, err
+		}
+		inPart := off % f.partSize
+		chunk := p[done:]
+		if rest := f.partSize - inPart; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		n, err := part.WriteAt(chunk, inPart)
+		done += n
+		off += int64(n)
+		if err != nil {
+			return done, err
+		}
+	}
+	return done, nil
+}
+
+// size returns the size of the whole file.
+func (f *SplitFile) size() (int64, error) {
+	n := len(f.parts)
+	if n == 0 {
+		return 0, nil
+	}
+	info, err := f.parts[n-1].Stat()
+	if err != nil {
+		return 0, err
+	}
+	return int64(n-1)*f.partSize + info.Size(), nil
+}
+
+// Seek can go past the end.  Parts are only created by writing.
+func (f *SplitFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		break
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		size, err := f.size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, fmt.Errorf("Unsupported seek whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.New("Seek to negative position")
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+// Sync flushes every part to stable storage.
+func (f *SplitFile) Sync() error {
+	for _, part := range f.parts {
+		if err := part.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every part, returning the first error.
+func (f *SplitFile) Close() error {
+	var result error
+	for _, part := range f.parts {
+		if err := part.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	f.parts = nil
+	return result
+}
@@ -0,0 +1,118 @@
+//go:build fuse
+// +build fuse
+
+// Package archivefs mounts an archive read-only with FUSE, with each
+// image as a file in the root directory.  Images are read in place, so
+// nothing is extracted.
+package archivefs
+
+import (
+	"../archive"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+)
+
+// FS is the file system of an archive.
+type FS struct {
+	files map[string]*imageFile
+}
+
+// New makes the file system of a.  Images that can't be read are left
+// out and logged.
+func New(a *archive.Archive) *FS {
+	result := &FS{files: make(map[string]*imageFile)}
+	for i := 0; i < a.ImageCount(); i++ {
+		r, size, err := a.ImageReaderAt(i)
+		if err != nil {
+			log.Println("Leaving out image", i, err)
+			continue
+		}
+		result.files[fmt.Sprintf("image-%d", i)] = &imageFile{
+			inode:  uint64(i) + 2,
+			reader: r,
+			size:   size,
+		}
+	}
+	return result
+}
+
+// Mount mounts a on dir and serves it until it is unmounted.  An error
+// mounting is returned by fuse.Mount, which waits for the mount to be
+// ready.
+func Mount(dir string, a *archive.Archive) error {
+	c, err := fuse.Mount(dir, fuse.ReadOnly(), fuse.FSName("cvtm"),
+		fuse.Subtype("cvtm"))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	return fs.Serve(c, New(a))
+}
+
+func (f *FS) Root() (fs.Node, error) {
+	return rootDir{f}, nil
+}
+
+type rootDir struct {
+	fs *FS
+}
+
+func (d rootDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = 1
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+func (d rootDir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	if file, ok := d.fs.files[name]; ok {
+		return file, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d rootDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	var result []fuse.Dirent
+	for name, file := range d.fs.files {
+		result = append(result, fuse.Dirent{
+			Inode: file.inode,
+			Type:  fuse.DT_File,
+			Name:  name,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Inode < result[j].Inode
+	})
+	return result, nil
+}
+
+type imageFile struct {
+	inode  uint64
+	reader io.ReaderAt
+	size   int64
+}
+
+func (f *imageFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Inode = f.inode
+	a.Mode = 0444
+	a.Size = uint64(f.size)
+	return nil
+}
+
+func (f *imageFile) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	data := make([]byte, req.Size)
+	n, err := f.reader.ReadAt(data, req.Offset)
+	if err != nil && err != io.EOF {
+		log.Println("Error reading at", req.Offset, err)
+		return fuse.EIO
+	}
+	resp.Data = data[:n]
+	return nil
+}
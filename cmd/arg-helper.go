@@ -1,12 +1,15 @@
 package cmd
 
 import (
+	"../archive"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/pflag"
 )
@@ -45,7 +48,43 @@ func flagEnumVar(fs *pflag.FlagSet, dest *uint32, name string, value string, usa
 	*dest = choices[value]
 }
 
-func readMaybePEM(name, blockType string) []byte {
+func enumName(choices map[string]uint32, value uint32) string {
+	for name, v := range choices {
+		if v == value {
+			return name
+		}
+	}
+	return fmt.Sprintf("unknown(%d)", value)
+}
+
+// parseIndexList parses a list like "0,2,5-7".  Ranges are kept as
+// they are, so a huge one takes no memory.
+func parseIndexList(s string) ([]archive.IndexRange, error) {
+	result := []archive.IndexRange{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad index %#v", part)
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, fmt.Errorf("bad index range %#v", part)
+			}
+		}
+		if first < 0 || last < first {
+			return nil, fmt.Errorf("bad index range %#v", part)
+		}
+		result = append(result, archive.IndexRange{First: first, Last: last})
+	}
+	return result, nil
+}
+
+// readMaybePEM reads a PEM block of one of blockTypes, or DER.  The
+// block type is empty for DER.
+func readMaybePEM(name string, blockTypes ...string) *pem.Block {
 	result, err := ioutil.ReadFile(name)
 	if err != nil {
 		log.Println("Error reading key file", err)
@@ -59,13 +98,15 @@ func readMaybePEM(name, blockType string) []byte {
 			log.Println("Got extra data in key file")
 			os.Exit(1)
 		}
-		if block.Type != blockType {
-			log.Printf("Expected %s, got %#v\n", blockType,
-				block.Type)
-			os.Exit(1)
+		for _, t := range blockTypes {
+			if block.Type == t {
+				return block
+			}
 		}
-		result = block.Bytes
+		log.Printf("Expected %v, got %#v\n", blockTypes,
+			block.Type)
+		os.Exit(1)
 	}
 
-	return result
+	return &pem.Block{Bytes: result}
 }
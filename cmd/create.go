@@ -4,8 +4,11 @@ import (
 	"../archive"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 
 	"github.com/spf13/cobra"
@@ -26,10 +29,61 @@ to quickly create a Cobra application.`,
 
 var createOptions archive.NewArchiveOptions
 
+var endingCipherChoices = map[string]uint32{
+	"null": archive.EndingCipherNull,
+	"rsa":  archive.EndingCipherRSA,
+}
+
+// Built from archive.EndPointerChecksums, so every registered algorithm
+// can be chosen
+var endPointerChecksumChoices = func() map[string]uint32 {
+	result := make(map[string]uint32)
+	for id, algo := range archive.EndPointerChecksums {
+		result[algo.Name] = id
+	}
+	return result
+}()
+
+var headerChecksumChoices = map[string]uint32{
+	"crc32c": archive.HeaderChecksumCRC32C,
+	"sha256": archive.HeaderChecksumSHA256,
+}
+
+var fillChoices = map[string]uint32{
+	"discard": archive.FillDiscard,
+	"pattern": archive.FillPattern,
+	"random":  archive.FillRandom,
+	"seek":    archive.FillSeek,
+	"zero":    archive.FillZero,
+}
+
+var imgCipherChoices = map[string]uint32{
+	"null":    archive.ImgCipherNull,
+	"xts-aes": archive.ImgCipherXTSAES,
+}
+
+var imgCompressionChoices = map[string]uint32{
+	"none": archive.ImgCompressionNone,
+	"zlib": archive.ImgCompressionZlib,
+	"zstd": archive.ImgCompressionZstd,
+}
+
+var clusterCheckChoices = map[string]uint32{
+	"none":  archive.ClusterCheckNone,
+	"crc32": archive.ClusterCheckCRC32,
+}
+
 var createOptionsMore struct {
-	auBytes   uint32
-	file      string
-	publicKey string
+	auBytes     uint32
+	blockSize   uint32
+	endPointers []uint
+	expectSdCid string
+	file        string
+	fillPattern string
+	publicKey   string
+	randConf    archive.RandReaderConf
+	sdCid       string
+	splitSize   int64
 }
 
 func init() {
@@ -39,36 +93,57 @@ func init() {
 
 	flag.Uint32Var(&createOptionsMore.auBytes, "au", 0x10000,
 		"Allocation unit in bytes")
+	flag.Uint32Var(&createOptionsMore.blockSize, "block-size", archive.BlockSize,
+		"Block size in bytes, a power of 2.  4096 suits 4K native devices")
 	flagEnumVar(flag, &createOptions.EndingCipher, "ending-cipher",
-		"rsa", "Ending cipher", map[string]uint32{
-			"null": archive.EndingCipherNull,
-			"rsa":  archive.EndingCipherRSA,
-		})
+		"rsa", "Ending cipher", endingCipherChoices)
 	flagEnumVar(flag, &createOptions.EndPointerChecksum, "end-pointer-checksum",
-		"sha256", "Type of end pointer checksum", map[string]uint32{
-			"crc32":  archive.EndPointerChecksumCRC32,
-			"sha256": archive.EndPointerChecksumSHA256,
-		})
+		"sha256", "Type of end pointer checksum", endPointerChecksumChoices)
+	flagEnumVar(flag, &createOptions.HeaderChecksum, "header-checksum",
+		"sha256", "Type of header checksum", headerChecksumChoices)
 	flag.UintVar(&createOptions.EndPointersHead, "end-pointers-head", 1,
 		"Number of end pointers before the image area")
 	flag.UintVar(&createOptions.EndPointersTail, "end-pointers-tail", 1,
 		"Number of end pointers after the image area")
+	flag.UintSliceVar(&createOptionsMore.endPointers, "end-pointer-blocks", nil,
+		"Blocks to put end pointers at, like 2048,4096, instead of --end-pointers-head and --end-pointers-tail")
 	flagEnumVar(flag, &createOptions.FillMethod, "fill", "random",
-		"Method to fill unused space", map[string]uint32{
-			"random": archive.FillRandom,
-			"seek":   archive.FillSeek,
-			"zero":   archive.FillZero,
-		})
+		"Method to fill unused space", fillChoices)
+	flag.StringVar(&createOptionsMore.fillPattern, "fill-pattern", "",
+		"Bytes in hex to repeat with --fill pattern, like deadbeef")
 	flagEnumVar(flag, &createOptions.ImgCipher, "image-cipher", "xts-aes",
-		"Image cipher", map[string]uint32{
-			"null":    archive.ImgCipherNull,
-			"xts-aes": archive.ImgCipherXTSAES,
-		})
+		"Image cipher", imgCipherChoices)
+	flagEnumVar(flag, &createOptions.ImgCompression, "image-compression", "none",
+		"How the device compresses image clusters, for extract to expand them", imgCompressionChoices)
 	flag.StringVar(&createOptionsMore.publicKey, "public-key", "",
 		"RSA public key file name")
 	flag.StringVar(&createOptionsMore.file, "file", "", "File")
+	flag.Int64Var(&createOptionsMore.splitSize, "split-size", 0,
+		"Split the output into files of this many bytes, named like FILE.001")
 	flag.Int64Var(&createOptions.DiskSize, "size", -1,
 		"Output size in bytes")
+	flag.BoolVar(&createOptions.DryRun, "dry-run", false,
+		"Check the layout fits without writing anything")
+	flag.BoolVar(&createOptions.Resume, "resume", false,
+		"Continue an interrupted run with the same options")
+	flag.Int64Var(&createOptions.ResumeFrom, "resume-from", 0,
+		"Byte position to continue filling from with --resume")
+	flag.StringVar(&createOptionsMore.expectSdCid, "expect-sd-cid", "",
+		"Only write if the output is the SD card with this CID, in hex")
+	flag.StringVar(&createOptionsMore.sdCid, "sd-cid", "",
+		"Record this SD card CID in the header, in hex, so extract --check-sd-cid can check it")
+	flag.BoolVar(&createOptions.RecordSdCid, "record-sd-cid", false,
+		"Record the CID of the output SD card in the header")
+	flag.Uint32Var(&createOptions.MinEndingBlocks, "min-ending-blocks", 0,
+		"Reserve at least this many blocks for each image's ending")
+	flag.BoolVar(&createOptions.GlobalLogChecksums, "global-log-checksums", false,
+		"Put a checksum of each global log in the header")
+	flag.BoolVar(&createOptions.ClusterChecksums, "cluster-checksums", false,
+		"Have images keep a checksum of each data cluster, for extract --verify-clusters")
+	flag.IntVar(&createOptionsMore.randConf.Workers, "random-workers", 0,
+		"Number of workers generating random fill (default number of CPUs + 1)")
+	flag.IntVar(&createOptionsMore.randConf.BufferSize, "random-buffer-size", 0,
+		"Bytes of random fill each worker buffers (default 4MiB)")
 }
 
 func doCreateCmd(cmd *cobra.Command, args []string) {
@@ -84,14 +159,21 @@ func doCreateCmd(cmd *cobra.Command, args []string) {
 		Size: 1,
 	}}
 
-	if !(createOptionsMore.auBytes >= archive.BlockSize &&
+	blockSize := createOptionsMore.blockSize
+	if !(blockSize >= archive.BlockSize && (blockSize&(blockSize-1)) == 0) {
+		log.Println("Block size must be a power of 2, at least", archive.BlockSize)
+		os.Exit(1)
+	}
+	createOptions.BlockSize = int64(blockSize)
+
+	if !(createOptionsMore.auBytes >= blockSize &&
 		((createOptionsMore.auBytes & (createOptionsMore.auBytes - 1)) == 0)) {
 		log.Println("Allocation unit must be power of 2 blocks")
 		os.Exit(1)
 	}
-	createOptions.AlignmentBlocks = int64(createOptionsMore.auBytes / archive.BlockSize)
+	createOptions.AlignmentBlocks = int64(createOptionsMore.auBytes / blockSize)
 
-	createOptions.ImgClusterSizeExp = bytesToBlkExp(createOptionsMore.auBytes)
+	createOptions.ImgClusterSizeExp = bytesToBlkExp(createOptionsMore.auBytes, blockSize)
 
 	if createOptions.EndingCipher == archive.EndingCipherRSA {
 		if len(createOptionsMore.publicKey) == 0 {
@@ -105,18 +187,86 @@ func doCreateCmd(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	archive.RandReaderInit()
+	for _, blk := range createOptionsMore.endPointers {
+		if blk > math.MaxUint32 {
+			log.Println("End pointer block too big", blk)
+			os.Exit(1)
+		}
+		createOptions.EndPointerBlocks = append(createOptions.EndPointerBlocks, uint32(blk))
+	}
 
-	var file *os.File
+	if createOptions.FillMethod == archive.FillPattern {
+		pattern, err := hex.DecodeString(createOptionsMore.fillPattern)
+		if err != nil || len(pattern) == 0 {
+			log.Println("Bad fill pattern", createOptionsMore.fillPattern)
+			os.Exit(1)
+		}
+		createOptions.FillPattern = pattern
+	} else if len(createOptionsMore.fillPattern) != 0 {
+		log.Println("Fill pattern given, but fill method isn't pattern")
+		os.Exit(1)
+	}
+
+	if len(createOptionsMore.expectSdCid) != 0 {
+		cid, err := archive.ParseSdCid(createOptionsMore.expectSdCid)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		createOptions.ExpectSdCid = &cid
+	}
+
+	if len(createOptionsMore.sdCid) != 0 {
+		if createOptions.RecordSdCid {
+			log.Println("Both --sd-cid and --record-sd-cid given")
+			os.Exit(1)
+		}
+		cid, err := archive.ParseSdCid(createOptionsMore.sdCid)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		createOptions.SdCid = &cid
+	}
+
+	if !createOptions.DryRun {
+		archive.RandReaderInitConf(&createOptionsMore.randConf)
+	}
+
+	var file interface {
+		io.ReadWriteSeeker
+		Sync() error
+	}
 	if len(createOptionsMore.file) == 0 {
 		log.Println("File not given")
 		os.Exit(1)
 	} else if createOptionsMore.file == "-" {
 		file = os.Stdout
-	} else {
+	} else if createOptionsMore.splitSize > 0 {
+		if createOptions.DiskSize <= 0 {
+			log.Println("Output size must be given to split the output")
+			os.Exit(1)
+		}
+		if !createOptions.DryRun {
+			var err error
+			file, err = archive.CreateSplitFile(createOptionsMore.file, createOptionsMore.splitSize)
+			if err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+		}
+	} else if !(createOptions.DryRun && createOptions.DiskSize > 0) ||
+		isBlockDevicePath(createOptionsMore.file) {
+		// A device is opened in a dry run too to check the size
 		var err error
 		flag := os.O_WRONLY
-		if createOptions.DiskSize > 0 {
+		if createOptions.DryRun {
+			// Only the size is needed
+			flag = os.O_RDONLY
+		} else if createOptions.Resume {
+			// The existing header is checked
+			flag = os.O_RDWR
+		} else if createOptions.DiskSize > 0 {
 			flag |= os.O_CREATE
 		}
 		file, err = os.OpenFile(createOptionsMore.file, flag, 0666)
@@ -125,7 +275,9 @@ func doCreateCmd(cmd *cobra.Command, args []string) {
 			os.Exit(1)
 		}
 	}
-	createOptions.Output = file
+	if file != nil {
+		createOptions.Output = file
+	}
 
 	if createOptions.DiskSize <= 0 {
 		size, err := file.Seek(0, io.SeekEnd)
@@ -144,11 +296,24 @@ func doCreateCmd(cmd *cobra.Command, args []string) {
 		createOptions.DiskSize = size
 	}
 
-	err := archive.WriteEmptyArchive(&createOptions)
+	layout, err := archive.WriteEmptyArchiveContext(interruptCtx, &createOptions)
+	archive.RandReaderClose()
 	if err != nil {
+		exitIfInterrupted(err)
 		log.Println(err)
 		os.Exit(1)
 	}
+	if createOptions.DryRun {
+		log.Printf("Header %d bytes, %d byte blocks, image area blocks %d to %d, end pointers at blocks %v\n",
+			layout.HeaderSize, layout.BlockSize, layout.ImgAreaStart,
+			layout.ImgAreaEnd, layout.EndPointers)
+		return
+	}
+	if !rootOptions.quiet {
+		log.Printf("Wrote %d bytes, header %d bytes, image area blocks %d to %d\n",
+			layout.BytesWritten, layout.HeaderSize,
+			layout.ImgAreaStart, layout.ImgAreaEnd)
+	}
 
 	if err := file.Sync(); err != nil {
 		log.Println(err)
@@ -156,12 +321,21 @@ func doCreateCmd(cmd *cobra.Command, args []string) {
 	}
 }
 
-func bytesToBlkExp(n uint32) uint8 {
-	if n < archive.BlockSize || (n&(n-1)) != 0 {
+func isBlockDevicePath(name string) bool {
+	info, err := os.Stat(name)
+	if err != nil {
+		return false
+	}
+	mode := info.Mode()
+	return mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0
+}
+
+func bytesToBlkExp(n uint32, blockSize uint32) uint8 {
+	if n < blockSize || (n&(n-1)) != 0 {
 		log.Printf("Not a power of 2 times block size %d\n", n)
 		os.Exit(1)
 	}
-	n /= 2 * archive.BlockSize
+	n /= 2 * blockSize
 	r := uint8(0)
 	for n != 0 {
 		r++
@@ -171,8 +345,21 @@ func bytesToBlkExp(n uint32) uint8 {
 }
 
 func readPublicKeyFile(name string) *rsa.PublicKey {
-	key, err := x509.ParsePKCS1PublicKey(readMaybePEM(name,
-		"RSA PUBLIC KEY"))
+	block := readMaybePEM(name, "RSA PUBLIC KEY", "PUBLIC KEY")
+	data := block.Bytes
+	var key *rsa.PublicKey
+	var err error
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(data)
+	case "PUBLIC KEY":
+		key, err = parsePKIXPublicKey(data)
+	default:
+		// DER doesn't say which it is
+		if key, err = x509.ParsePKCS1PublicKey(data); err != nil {
+			key, err = parsePKIXPublicKey(data)
+		}
+	}
 	if err != nil {
 		log.Println("Error parsing key file:", err)
 		os.Exit(1)
@@ -180,3 +367,15 @@ func readPublicKeyFile(name string) *rsa.PublicKey {
 
 	return key
 }
+
+func parsePKIXPublicKey(data []byte) (*rsa.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Public key is %T, not RSA", key)
+	}
+	return rsaKey, nil
+}
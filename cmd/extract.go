@@ -2,11 +2,16 @@ package cmd
 
 import (
 	"../archive"
+	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"text/template"
+	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -26,10 +31,29 @@ to quickly create a Cobra application.`,
 
 var extractOptions archive.ExtractOptions
 
+var compressionChoices = map[string]uint32{
+	"gzip": archive.CompressionGzip,
+	"none": archive.CompressionNone,
+	"zstd": archive.CompressionZstd,
+}
+
+var digestChoices = map[string]uint32{
+	"none":   0,
+	"sha256": uint32(crypto.SHA256),
+	"sha512": uint32(crypto.SHA512),
+}
+
 var extractOptionsMore struct {
-	file       string
-	privateKey string
-	imageNames string
+	file        string
+	privateKeys []string
+	imageNames  string
+	images      string
+	manifest    string
+	digest      uint32
+	makeDirs    bool
+	backingFile string
+	findHeader  int64
+	split       bool
 }
 
 func init() {
@@ -37,15 +61,65 @@ func init() {
 
 	flag := extractCmd.Flags()
 
-	flag.StringVar(&extractOptionsMore.file, "file", "", "File")
-	flag.StringVar(&extractOptionsMore.privateKey, "private-key", "",
-		"RSA private key file name")
+	flag.StringVar(&extractOptionsMore.file, "file", "",
+		"File, - for stdin, or an http or https URL read with range requests")
+	flag.BoolVar(&extractOptionsMore.split, "split", false,
+		"The archive is split into files named like FILE.001")
+	flag.StringArrayVar(&extractOptionsMore.privateKeys, "private-key", nil,
+		"RSA private key file name.  May be given more than once")
 	flag.BoolVar(&extractOptions.Overwrite, "overwrite", false,
 		"Allow extracted files to overwrite existing files")
+	flag.BoolVar(&extractOptions.SkipExisting, "skip-existing", false,
+		"Leave existing files, skipping their images, instead of failing")
 	flag.StringVar(&extractOptionsMore.imageNames, "image-name", "image-{{.Index}}",
-		"Template for names of extracted images")
+		"Template for names of extracted images.  hex and pad are available, like {{pad 3 .Index}}")
+	flag.StringVar(&extractOptionsMore.backingFile, "backing-file", "",
+		"Template for names of backing files of extracted images, to extract them as overlays")
+	flag.StringVar(&extractOptions.OutputDir, "output-dir", "",
+		"Directory to put extracted images in, created if missing")
+	flag.BoolVar(&extractOptionsMore.makeDirs, "make-dirs", false,
+		"Create missing directories in names of extracted images")
+	flag.IntVar(&extractOptions.ReadBufferSize, "buffer-size", 0,
+		"Size of read and write buffers in bytes (default 4KiB)")
+	flag.BoolVar(&extractOptions.Preallocate, "preallocate", false,
+		"Allocate each extracted file before writing it")
+	flag.BoolVar(&extractOptions.Sync, "sync", false,
+		"Flush each extracted image to stable storage before going on")
+	flag.IntVar(&extractOptions.CopyWorkers, "copy-workers", 0,
+		"Number of reads of image data at once")
+	flag.BoolVar(&extractOptions.Stream, "stream", false,
+		"Write extracted images without seeking, so they can be pipes.  Implied by --image-name -")
 	flag.BoolVar(&extractOptions.Raw, "raw", false,
 		"Don't convert to QCOW2")
+	flagEnumVar(flag, &extractOptions.Compression, "compress", "none",
+		"Compress extracted images, adding the extension to their names",
+		compressionChoices)
+	flag.BoolVar(&extractOptions.Strict, "strict", false,
+		"Abort on any anomaly in the archive, not only on fatal ones")
+	flag.BoolVar(&extractOptions.VerifyClusters, "verify-clusters", false,
+		"Check each data cluster against its checksum, if the archive has them")
+	flag.BoolVar(&extractOptions.ForceHeader, "no-header-check", false,
+		"Go on if the archive header checksum doesn't match, to recover a lightly damaged archive")
+	flag.Int64Var(&extractOptionsMore.findHeader, "find-header", 0,
+		"Search this many bytes for the archive header, if it isn't at the start")
+	flag.Uint32Var(&extractOptions.MaxHeaderSize, "max-header-size", 0,
+		"Largest archive header accepted in bytes, at most 256MiB (default 1MiB)")
+	flag.StringVar(&extractOptionsMore.images, "images", "",
+		"Indices of images to extract, like 0,2,5-7 (default all)")
+	flag.IntVar(&extractOptions.MaxImages, "max-images", 0,
+		"Fail if the archive has more images than this (default unlimited)")
+	flag.StringVar(&extractOptionsMore.manifest, "manifest", "",
+		"Write a JSON description of the extracted images to this file")
+	flagEnumVar(flag, &extractOptionsMore.digest, "digest", "none",
+		"Print the digest of each output file, and put it in the manifest",
+		digestChoices)
+	flag.BoolVar(&extractOptions.CheckSdCid, "check-sd-cid", false,
+		"Before extracting onto a block device, check it is the SD card recorded in the archive")
+	flag.BoolVar(&extractOptions.ForceSdCid, "force-sd-cid", false,
+		"Extract even if --check-sd-cid fails")
+	flag.BoolVar(&extractOptions.Salvage, "salvage", false,
+		"Skip images that can't be extracted, and search for endings past broken links")
+	flagKeyPassphrase(flag)
 }
 
 func doExtractCmd(cmd *cobra.Command, args []string) {
@@ -55,24 +129,57 @@ func doExtractCmd(cmd *cobra.Command, args []string) {
 	}
 
 	var err error
-	extractOptions.ImageNames, err = template.New("imageNames").Parse(extractOptionsMore.imageNames)
+	extractOptions.ImageNames, err = archive.ParseImageNames(extractOptionsMore.imageNames)
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
 
-	if len(extractOptionsMore.privateKey) != 0 {
-		extractOptions.PrivateKey = readPrivateKeyFile(
-			extractOptionsMore.privateKey)
-		if err := extractOptions.PrivateKey.Validate(); err != nil {
+	if len(extractOptionsMore.backingFile) != 0 {
+		extractOptions.BackingFile, err = archive.ParseImageNames(extractOptionsMore.backingFile)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if len(extractOptionsMore.images) != 0 {
+		extractOptions.IndexRanges, err = parseIndexList(extractOptionsMore.images)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	for _, name := range extractOptionsMore.privateKeys {
+		key := readPrivateKeyFile(name)
+		if err := key.Validate(); err != nil {
 			log.Println(err)
 			os.Exit(1)
 		}
+		extractOptions.PrivateKeys = append(extractOptions.PrivateKeys, key)
 	}
 
 	if len(extractOptionsMore.file) == 0 {
 		log.Println("File not given")
 		os.Exit(1)
+	} else if extractOptionsMore.file == "-" {
+		extractOptions.File = spoolStdin()
+	} else if strings.HasPrefix(extractOptionsMore.file, "http://") ||
+		strings.HasPrefix(extractOptionsMore.file, "https://") {
+		var err error
+		extractOptions.File, err = archive.OpenHTTPFile(extractOptionsMore.file, nil)
+		if err != nil {
+			log.Println("Error opening input", err)
+			os.Exit(1)
+		}
+	} else if extractOptionsMore.split {
+		var err error
+		extractOptions.File, err = archive.OpenSplitFile(extractOptionsMore.file)
+		if err != nil {
+			log.Println("Error opening input", err)
+			os.Exit(1)
+		}
 	} else {
 		var err error
 		extractOptions.File, err = os.Open(extractOptionsMore.file)
@@ -82,15 +189,129 @@ func doExtractCmd(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	if err := archive.ExtractArchive(&extractOptions); err != nil {
+	if extractOptionsMore.findHeader > 0 {
+		pos, err := archive.FindHeader(&extractOptions, extractOptionsMore.findHeader)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		if pos != 0 {
+			log.Println("Archive header found at byte", pos)
+			size, err := extractOptions.File.Seek(0, io.SeekEnd)
+			if err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+			extractOptions.File = io.NewSectionReader(extractOptions.File, pos, size-pos)
+		}
+	}
+
+	extractOptions.Digest = crypto.Hash(extractOptionsMore.digest)
+	if extractOptionsMore.makeDirs {
+		extractOptions.DirMode = 0777
+	}
+
+	results, extractErr := archive.ExtractArchiveContext(interruptCtx, &extractOptions)
+	if extractErr != nil {
+		exitIfInterrupted(extractErr)
+		log.Println(extractErr)
+		if !extractOptions.Salvage {
+			os.Exit(1)
+		}
+		// The images salvaged are still described
+	}
+
+	// Like sha256sum, so it can be checked with it
+	digestOut := os.Stdout
+	if extractOptionsMore.imageNames == "-" {
+		// The image is on stdout
+		digestOut = os.Stderr
+	}
+	for _, result := range results {
+		if len(result.Digest) != 0 {
+			fmt.Fprintf(digestOut, "%s  %s\n", result.Digest, result.Path)
+		}
+	}
+
+	if len(extractOptionsMore.manifest) != 0 {
+		if results == nil {
+			results = []archive.ExtractedImage{}
+		}
+		data, err := json.MarshalIndent(results, "", "\t")
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		if err := ioutil.WriteFile(extractOptionsMore.manifest, append(data, '\n'), 0666); err != nil {
+			log.Println("Error writing manifest", err)
+			os.Exit(1)
+		}
+	}
+
+	if extractErr != nil {
+		log.Printf("Extracted %d images, some were skipped\n", len(results))
+		os.Exit(1)
+	}
+}
+
+// Extraction needs random access, so stdin is copied to a temporary
+// file first.
+func spoolStdin() *os.File {
+	file, err := ioutil.TempFile("", "cvtm-extract-")
+	if err != nil {
+		log.Println("Error creating temporary file", err)
+		os.Exit(1)
+	}
+	// Unlink it right away so it's cleaned up however the process
+	// exits.
+	if err := os.Remove(file.Name()); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	if _, err := io.Copy(file, os.Stdin); err != nil {
+		log.Println("Error reading input", err)
+		os.Exit(1)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
+
+	return file
 }
 
 func readPrivateKeyFile(name string) *rsa.PrivateKey {
-	key, err := x509.ParsePKCS1PrivateKey(readMaybePEM(name,
-		"RSA PRIVATE KEY"))
+	block := readMaybePEM(name, "RSA PRIVATE KEY", "PRIVATE KEY",
+		"ENCRYPTED PRIVATE KEY")
+	data := block.Bytes
+	blockType := block.Type
+	var key *rsa.PrivateKey
+	var err error
+
+	if blockType == "ENCRYPTED PRIVATE KEY" {
+		data, err = decryptPKCS8(data, keyPassphrase(name))
+		blockType = "PRIVATE KEY"
+	} else if x509.IsEncryptedPEMBlock(block) {
+		// Legacy OpenSSL encryption
+		data, err = x509.DecryptPEMBlock(block, keyPassphrase(name))
+	}
+	if err != nil {
+		log.Println("Error decrypting key file:", err)
+		os.Exit(1)
+	}
+
+	switch blockType {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(data)
+	case "PRIVATE KEY":
+		key, err = parsePKCS8PrivateKey(data)
+	default:
+		// DER doesn't say which it is
+		if key, err = x509.ParsePKCS1PrivateKey(data); err != nil {
+			key, err = parsePKCS8PrivateKey(data)
+		}
+	}
 	if err != nil {
 		log.Println("Error parsing key file:", err)
 		os.Exit(1)
@@ -98,3 +319,15 @@ func readPrivateKeyFile(name string) *rsa.PrivateKey {
 
 	return key
 }
+
+func parsePKCS8PrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Private key is %T, only RSA is supported", key)
+	}
+	return rsaKey, nil
+}
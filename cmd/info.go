@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"../archive"
+	"../archive/entries"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// infoCmd represents the info command
+var infoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "Print the geometry recorded in an archive header",
+	Run:   doInfoCmd,
+}
+
+var infoOptions struct {
+	file string
+	json bool
+}
+
+func init() {
+	rootCmd.AddCommand(infoCmd)
+
+	flag := infoCmd.Flags()
+
+	flag.StringVar(&infoOptions.file, "file", "", "File")
+	flag.BoolVar(&infoOptions.json, "json", false, "Print as JSON")
+}
+
+type globalLogInfo struct {
+	Start uint32 `json:"start"`
+	Count uint32 `json:"count"`
+}
+
+type headerInfo struct {
+	HeaderLength        uint32          `json:"header_length"`
+	BlockSize           int64           `json:"block_size"`
+	ImageAreaStart      uint32          `json:"image_area_start"`
+	ImageAreaEnd        uint32          `json:"image_area_end"`
+	AllocationIncrement uint32          `json:"allocation_increment"`
+	EndingSize          uint32          `json:"ending_size"`
+	EndingCipher        string          `json:"ending_cipher"`
+	EndPointerChecksum  string          `json:"end_pointer_checksum"`
+	HeaderChecksum      string          `json:"header_checksum"`
+	EndPointers         []uint32        `json:"end_pointers"`
+	ImageCipher         string          `json:"image_cipher"`
+	ImageClusterSizeExp uint8           `json:"image_cluster_size_exp"`
+	ImageCompression    string          `json:"image_compression"`
+	ClusterChecksum     string          `json:"cluster_checksum"`
+	GlobalLogs          []globalLogInfo `json:"global_logs"`
+	ImageLogs           []uint32        `json:"image_logs"`
+	UnknownEntries      []string        `json:"unknown_entries"`
+	SdCid               *sdCidInfo      `json:"sd_cid,omitempty"`
+}
+
+type sdCidInfo struct {
+	Raw    string              `json:"raw"`
+	Fields archive.SdCidFields `json:"fields"`
+}
+
+func doInfoCmd(cmd *cobra.Command, args []string) {
+	if err := cobra.NoArgs(cmd, args); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	if len(infoOptions.file) == 0 {
+		log.Println("File not given")
+		os.Exit(1)
+	}
+	file, err := os.Open(infoOptions.file)
+	if err != nil {
+		log.Println("Error opening input", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	var header entries.ArchiveHeaderRead
+	if err := archive.ReadHeader(&archive.ExtractOptions{File: file}, &header); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	info := headerInfo{
+		HeaderLength:        header.CvtmMagic.HeaderLength,
+		BlockSize:           archive.HeaderBlockSize(&header),
+		ImageAreaStart:      header.ImageArea.Start,
+		ImageAreaEnd:        header.ImageArea.End,
+		AllocationIncrement: header.AllocateOnce.AllocationIncrement,
+		EndingSize:          header.EndingSize.Size,
+		EndingCipher:        enumName(endingCipherChoices, header.EndingCipher.Algo),
+		EndPointerChecksum:  enumName(endPointerChecksumChoices, header.EndPointerChec.Algo),
+		HeaderChecksum:      enumName(headerChecksumChoices, header.HeaderChecksum.Algo),
+		EndPointers:         []uint32{},
+		ImageCipher:         enumName(imgCipherChoices, header.ImageBasic.ImgCipher),
+		ImageClusterSizeExp: header.ImageBasic.ImgClusterSizeExp,
+		ImageCompression:    enumName(imgCompressionChoices, header.ImgCompression.Algo),
+		ClusterChecksum:     enumName(clusterCheckChoices, header.ClusterCheck.Algo),
+		GlobalLogs:          []globalLogInfo{},
+		ImageLogs:           []uint32{},
+		UnknownEntries:      []string{},
+	}
+	for _, e := range header.EndPointerLoca {
+		info.EndPointers = append(info.EndPointers, e.Blk)
+	}
+	for _, e := range header.GlobalLogLocat {
+		info.GlobalLogs = append(info.GlobalLogs, globalLogInfo{e.Start, e.Count})
+	}
+	for _, e := range header.ImageLog {
+		info.ImageLogs = append(info.ImageLogs, e.BlkCount)
+	}
+	if header.SdCid.SdCid != [15]byte{} {
+		info.SdCid = &sdCidInfo{
+			Raw:    hex.EncodeToString(header.SdCid.SdCid[:]),
+			Fields: archive.DecodeSdCid(header.SdCid.SdCid),
+		}
+	}
+	for _, e := range header.UnknownEntries {
+		info.UnknownEntries = append(info.UnknownEntries,
+			string(bytes.TrimRight(e.ID[:], "\x00")))
+	}
+
+	if infoOptions.json {
+		out, err := json.MarshalIndent(info, "", "\t")
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+		return
+	}
+
+	fmt.Printf("Header length:        %d bytes\n", info.HeaderLength)
+	fmt.Printf("Block size:           %d bytes\n", info.BlockSize)
+	fmt.Printf("Image area:           blocks %d to %d\n", info.ImageAreaStart, info.ImageAreaEnd)
+	fmt.Printf("Allocation increment: %d\n", info.AllocationIncrement)
+	fmt.Printf("Ending size:          %d blocks\n", info.EndingSize)
+	fmt.Printf("Ending cipher:        %s\n", info.EndingCipher)
+	fmt.Printf("End pointer checksum: %s\n", info.EndPointerChecksum)
+	fmt.Printf("End pointers:         %d %v\n", len(info.EndPointers), info.EndPointers)
+	fmt.Printf("Header checksum:      %s\n", info.HeaderChecksum)
+	fmt.Printf("Image cipher:         %s\n", info.ImageCipher)
+	fmt.Printf("Image cluster size:   %d bytes\n", info.BlockSize<<info.ImageClusterSizeExp)
+	fmt.Printf("Image compression:    %s\n", info.ImageCompression)
+	fmt.Printf("Cluster checksum:     %s\n", info.ClusterChecksum)
+	for i, e := range info.GlobalLogs {
+		fmt.Printf("Global log %d:         blocks %d, count %d\n", i, e.Start, e.Count)
+	}
+	for i, e := range info.ImageLogs {
+		fmt.Printf("Image log %d:          %d blocks\n", i, e)
+	}
+	if info.SdCid != nil {
+		fmt.Printf("SD card CID:          %s\n", info.SdCid.Raw)
+		fmt.Printf("                      %s\n", info.SdCid.Fields)
+	}
+	if len(info.UnknownEntries) != 0 {
+		fmt.Printf("Unknown entries:      %q\n", info.UnknownEntries)
+		fmt.Println("The archive may use features this version doesn't support")
+	}
+}
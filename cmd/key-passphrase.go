@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/term"
+)
+
+const passphraseEnv = "CVTM_KEY_PASSPHRASE"
+
+var keyPassphraseArg string
+
+func flagKeyPassphrase(fs *pflag.FlagSet) {
+	fs.StringVar(&keyPassphraseArg, "key-passphrase", "",
+		"Passphrase of encrypted private keys.  Read from $"+passphraseEnv+
+			" if not given, or asked for on a terminal")
+}
+
+// keyPassphrase returns the passphrase for the key file name, asking for
+// it on the terminal if it isn't given.
+func keyPassphrase(name string) []byte {
+	if len(keyPassphraseArg) != 0 {
+		return []byte(keyPassphraseArg)
+	}
+	if passphrase, ok := os.LookupEnv(passphraseEnv); ok {
+		return []byte(passphrase)
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		log.Println("Key file is encrypted, but passphrase is not given:", name)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "Passphrase for %s: ", name)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		log.Println("Error reading passphrase", err)
+		os.Exit(1)
+	}
+	return passphrase
+}
+
+// PKCS8 encryption, RFC 5958 and RFC 8018.  Only PBES2 with PBKDF2 and
+// AES-CBC is supported, which is what OpenSSL writes by default.
+
+var (
+	oidPBES2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// Most PBKDF2 iterations accepted.  OpenSSL writes 2048 by default, and
+// a huge count in a bad key file would take forever.
+const maxPBKDF2Iterations = 10000000
+
+type encryptedPrivateKeyInfo struct {
+	Algo          pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts an ENCRYPTED PRIVATE KEY into a PKCS8 key.
+func decryptPKCS8(data []byte, passphrase []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("Unsupported key encryption %v", info.Algo.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+
+	// Key derivation
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("Unsupported key derivation %v", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	if kdf.IterationCount <= 0 || kdf.IterationCount > maxPBKDF2Iterations {
+		return nil, fmt.Errorf("Bad key derivation iteration count %d", kdf.IterationCount)
+	}
+	var prf func() hash.Hash
+	switch {
+	case len(kdf.PRF.Algorithm) == 0 || kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("Unsupported key derivation PRF %v", kdf.PRF.Algorithm)
+	}
+
+	// Cipher
+	var keySize int
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keySize = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keySize = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keySize = 32
+	default:
+		return nil, fmt.Errorf("Unsupported key cipher %v", params.EncryptionScheme.Algorithm)
+	}
+	if kdf.KeyLength != 0 && kdf.KeyLength != keySize {
+		return nil, fmt.Errorf("Bad key length %d", kdf.KeyLength)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("Bad IV length %d", len(iv))
+	}
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errors.New("Encrypted key isn't whole blocks")
+	}
+
+	// Decrypt
+	key := pbkdf2.Key(passphrase, kdf.Salt, kdf.IterationCount, keySize, prf)
+	blockCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(blockCipher, iv).CryptBlocks(result, info.EncryptedData)
+
+	// Remove padding.  Bad padding almost always means a wrong
+	// passphrase.
+	pad := int(result[len(result)-1])
+	if pad == 0 || pad > aes.BlockSize ||
+		!bytes.Equal(result[len(result)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, errors.New("Wrong passphrase")
+	}
+	return result[:len(result)-pad], nil
+}
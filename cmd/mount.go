@@ -0,0 +1,83 @@
+//go:build fuse
+// +build fuse
+
+package cmd
+
+import (
+	"../archive"
+	"../archivefs"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// mountCmd represents the mount command
+var mountCmd = &cobra.Command{
+	Use:   "mount MOUNTPOINT",
+	Short: "Mount an archive read-only, with each image as a file",
+	Run:   doMountCmd,
+}
+
+var mountOptions struct {
+	file        string
+	privateKeys []string
+	strict      bool
+}
+
+func init() {
+	rootCmd.AddCommand(mountCmd)
+
+	flag := mountCmd.Flags()
+
+	flag.StringVar(&mountOptions.file, "file", "", "File")
+	flag.StringArrayVar(&mountOptions.privateKeys, "private-key", nil,
+		"RSA private key file name.  May be given more than once")
+	flagKeyPassphrase(flag)
+	flag.BoolVar(&mountOptions.strict, "strict", false,
+		"Abort on any anomaly in the archive, not only on fatal ones")
+}
+
+func doMountCmd(cmd *cobra.Command, args []string) {
+	if err := cobra.ExactArgs(1)(cmd, args); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	options := archive.ExtractOptions{
+		Strict: mountOptions.strict,
+	}
+
+	for _, name := range mountOptions.privateKeys {
+		key := readPrivateKeyFile(name)
+		if err := key.Validate(); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		options.PrivateKeys = append(options.PrivateKeys, key)
+	}
+
+	if len(mountOptions.file) == 0 {
+		log.Println("File not given")
+		os.Exit(1)
+	}
+	var err error
+	options.File, err = os.Open(mountOptions.file)
+	if err != nil {
+		log.Println("Error opening input", err)
+		os.Exit(1)
+	}
+
+	a, err := archive.OpenArchive(&options)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	if err := archivefs.Mount(args[0], a); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	if err := a.Close(); err != nil {
+		log.Println(err)
+	}
+}
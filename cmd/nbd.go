@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"../archive"
+	"../nbd"
+	"log"
+	"net"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// nbdCmd represents the nbd command
+var nbdCmd = &cobra.Command{
+	Use:   "nbd",
+	Short: "Serve an image in an archive read-only over NBD",
+	Run:   doNbdCmd,
+}
+
+var nbdOptions struct {
+	file        string
+	privateKeys []string
+	image       int
+	listen      string
+	strict      bool
+}
+
+func init() {
+	rootCmd.AddCommand(nbdCmd)
+
+	flag := nbdCmd.Flags()
+
+	flag.StringVar(&nbdOptions.file, "file", "", "File")
+	flag.StringArrayVar(&nbdOptions.privateKeys, "private-key", nil,
+		"RSA private key file name.  May be given more than once")
+	flagKeyPassphrase(flag)
+	flag.IntVar(&nbdOptions.image, "image", 0, "Index of the image to serve")
+	flag.StringVar(&nbdOptions.listen, "listen", "localhost:10809",
+		"Address to listen on")
+	flag.BoolVar(&nbdOptions.strict, "strict", false,
+		"Abort on any anomaly in the archive, not only on fatal ones")
+}
+
+func doNbdCmd(cmd *cobra.Command, args []string) {
+	if err := cobra.NoArgs(cmd, args); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	options := archive.ExtractOptions{
+		Strict: nbdOptions.strict,
+	}
+
+	for _, name := range nbdOptions.privateKeys {
+		key := readPrivateKeyFile(name)
+		if err := key.Validate(); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		options.PrivateKeys = append(options.PrivateKeys, key)
+	}
+
+	if len(nbdOptions.file) == 0 {
+		log.Println("File not given")
+		os.Exit(1)
+	}
+	var err error
+	options.File, err = os.Open(nbdOptions.file)
+	if err != nil {
+		log.Println("Error opening input", err)
+		os.Exit(1)
+	}
+
+	a, err := archive.OpenArchive(&options)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	server, err := nbd.NewImageServer(a, nbdOptions.image)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	l, err := net.Listen("tcp", nbdOptions.listen)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	log.Printf("Serving image %d, %d bytes, on %s\n",
+		nbdOptions.image, server.Size, l.Addr())
+	if err := server.Serve(l); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
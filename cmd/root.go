@@ -1,10 +1,15 @@
 package cmd
 
 import (
+	"../archive"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"github.com/spf13/cobra"
 	"os"
 	"log"
+	"os/signal"
 
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
@@ -25,6 +30,40 @@ to quickly create a Cobra application.`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	//	Run: func(cmd *cobra.Command, args []string) { },
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		interruptCtx, _ = signal.NotifyContext(context.Background(), os.Interrupt)
+
+		if rootOptions.verbose != 0 && rootOptions.quiet {
+			log.Println("Only one of --verbose and --quiet can be given")
+			os.Exit(1)
+		}
+		if rootOptions.verbose >= 1 {
+			archive.Info = log.Default()
+		}
+		if rootOptions.verbose >= 2 {
+			archive.Debug = log.Default()
+		}
+		if rootOptions.quiet {
+			archive.Warn = log.New(ioutil.Discard, "", 0)
+		}
+	},
+}
+
+var rootOptions struct {
+	verbose int
+	quiet   bool
+}
+
+// Done on SIGINT, so long operations can stop cleanly
+var interruptCtx = context.Background()
+
+// exitIfInterrupted exits with the usual status for SIGINT if err is
+// from being interrupted.
+func exitIfInterrupted(err error) {
+	if errors.Is(err, context.Canceled) {
+		log.Println("Interrupted")
+		os.Exit(130)
+	}
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -44,6 +83,12 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.cvtm.yaml)")
+	rootCmd.PersistentFlags().CountVarP(&rootOptions.verbose, "verbose", "v",
+		"Also log progress.  Given twice, also log details like each image ending read")
+	rootCmd.PersistentFlags().BoolVarP(&rootOptions.quiet, "quiet", "q", false,
+		"Only log errors that stop the command")
+	rootCmd.PersistentFlags().IntVar(&archive.Threads, "threads", archive.Threads,
+		"Most threads working at once")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"../archive"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// selftestCmd represents the selftest command
+var selftestCmd = &cobra.Command{
+	Use:    "selftest",
+	Short:  "Create an archive, add an image, extract it, and compare",
+	Hidden: true,
+	Run:    doSelftestCmd,
+}
+
+var selftestOptions struct {
+	dir string
+}
+
+func init() {
+	rootCmd.AddCommand(selftestCmd)
+
+	flag := selftestCmd.Flags()
+
+	flag.StringVar(&selftestOptions.dir, "dir", "",
+		"Directory for temporary files.  The system's default if empty")
+}
+
+func doSelftestCmd(cmd *cobra.Command, args []string) {
+	if err := cobra.NoArgs(cmd, args); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	archive.RandReaderInit()
+	err := archive.TestRoundTrip(selftestOptions.dir)
+	archive.RandReaderClose()
+	if err != nil {
+		log.Println("Self-test failed", err)
+		os.Exit(1)
+	}
+	log.Println("Self-test passed")
+}
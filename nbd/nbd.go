@@ -0,0 +1,302 @@
+// Package nbd serves an image in an archive read-only with the network
+// block device protocol, so it can be used without extracting it.  Only
+// the fixed newstyle handshake is supported.
+package nbd
+
+import (
+	"../archive"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+)
+
+const (
+	magicNBD      = 0x4e42444d41474943 // "NBDMAGIC"
+	magicOption   = 0x49484156454f5054 // "IHAVEOPT"
+	magicReply    = 0x0003e889045565a9
+	magicRequest  = 0x25609513
+	magicResponse = 0x67446698
+)
+
+// Handshake flags
+const (
+	flagFixedNewstyle = 1 << 0
+	flagNoZeroes      = 1 << 1
+)
+
+// Transmission flags
+const (
+	flagHasFlags = 1 << 0
+	flagReadOnly = 1 << 1
+)
+
+// Options
+const (
+	optExportName = 1
+	optAbort      = 2
+	optList       = 3
+	optInfo       = 6
+	optGo         = 7
+)
+
+// Option replies
+const (
+	repAck        = 1
+	repServer     = 2
+	repInfo       = 3
+	repErrUnsup   = 1<<31 + 1
+	repErrInvalid = 1<<31 + 3
+)
+
+const infoExport = 0
+
+// Commands
+const (
+	cmdRead  = 0
+	cmdWrite = 1
+	cmdDisc  = 2
+	cmdFlush = 3
+)
+
+// Errors in replies
+const (
+	errPerm  = 1
+	errIO    = 5
+	errInval = 22
+)
+
+// Longest request accepted, as recommended by the protocol
+const maxRequestLength = 32 << 20
+
+// Longest option accepted
+const maxOptionLength = 4096
+
+// Server serves one read-only disk under any export name.
+type Server struct {
+	Name   string
+	Reader io.ReaderAt
+	Size   int64
+}
+
+// NewImageServer returns a server for image index of a.
+func NewImageServer(a *archive.Archive, index int) (*Server, error) {
+	r, size, err := a.ImageReaderAt(index)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		Name:   fmt.Sprintf("image-%d", index),
+		Reader: r,
+		Size:   size,
+	}, nil
+}
+
+// Serve accepts connections on l, and serves each.  It returns when l
+// fails.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.ServeConn(conn); err != nil {
+				log.Println("Error serving", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn does the handshake and serves requests until the client
+// disconnects.
+func (s *Server) ServeConn(conn io.ReadWriter) error {
+	ok, err := s.handshake(conn)
+	if err != nil || !ok {
+		return err
+	}
+	return s.transmit(conn)
+}
+
+// handshake negotiates options.  ok is false if the client gave up.
+func (s *Server) handshake(conn io.ReadWriter) (ok bool, err error) {
+	if err := write(conn, uint64(magicNBD), uint64(magicOption),
+		uint16(flagFixedNewstyle|flagNoZeroes)); err != nil {
+		return false, err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(conn, binary.BigEndian, &clientFlags); err != nil {
+		return false, err
+	}
+	if clientFlags&flagFixedNewstyle == 0 {
+		return false, errors.New("Client doesn't support fixed newstyle handshake")
+	}
+	noZeroes := clientFlags&flagNoZeroes != 0
+
+	for {
+		var opt struct {
+			Magic  uint64
+			Option uint32
+			Length uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &opt); err != nil {
+			return false, err
+		}
+		if opt.Magic != magicOption {
+			return false, fmt.Errorf("Bad option magic number %#x", opt.Magic)
+		}
+		if opt.Length > maxOptionLength {
+			return false, fmt.Errorf("Option too long, %d bytes", opt.Length)
+		}
+		data := make([]byte, opt.Length)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return false, err
+		}
+
+		switch opt.Option {
+		case optExportName:
+			// No reply is possible if this fails, so any name
+			// is taken
+			if err := write(conn, uint64(s.Size), s.transmissionFlags()); err != nil {
+				return false, err
+			}
+			if !noZeroes {
+				if _, err := conn.Write(make([]byte, 124)); err != nil {
+					return false, err
+				}
+			}
+			return true, nil
+		case optAbort:
+			return false, reply(conn, opt.Option, repAck, nil)
+		case optList:
+			name := make([]byte, 4+len(s.Name))
+			binary.BigEndian.PutUint32(name, uint32(len(s.Name)))
+			copy(name[4:], s.Name)
+			if err := reply(conn, opt.Option, repServer, name); err != nil {
+				return false, err
+			}
+			if err := reply(conn, opt.Option, repAck, nil); err != nil {
+				return false, err
+			}
+		case optInfo, optGo:
+			// Only the export info is given, which is always
+			// allowed
+			if len(data) < 6 || int(binary.BigEndian.Uint32(data))+6 > len(data) {
+				if err := reply(conn, opt.Option, repErrInvalid, nil); err != nil {
+					return false, err
+				}
+				continue
+			}
+			info := make([]byte, 12)
+			binary.BigEndian.PutUint16(info[0:2], infoExport)
+			binary.BigEndian.PutUint64(info[2:10], uint64(s.Size))
+			binary.BigEndian.PutUint16(info[10:12], s.transmissionFlags())
+			if err := reply(conn, opt.Option, repInfo, info); err != nil {
+				return false, err
+			}
+			if err := reply(conn, opt.Option, repAck, nil); err != nil {
+				return false, err
+			}
+			if opt.Option == optGo {
+				return true, nil
+			}
+		default:
+			if err := reply(conn, opt.Option, repErrUnsup, nil); err != nil {
+				return false, err
+			}
+		}
+	}
+}
+
+func (s *Server) transmissionFlags() uint16 {
+	return flagHasFlags | flagReadOnly
+}
+
+func (s *Server) transmit(conn io.ReadWriter) error {
+	for {
+		var req struct {
+			Magic  uint32
+			Flags  uint16
+			Type   uint16
+			Handle uint64
+			Offset uint64
+			Length uint32
+		}
+		if err := binary.Read(conn, binary.BigEndian, &req); err != nil {
+			return err
+		}
+		if req.Magic != magicRequest {
+			return fmt.Errorf("Bad request magic number %#x", req.Magic)
+		}
+
+		switch req.Type {
+		case cmdRead:
+			if req.Length > maxRequestLength ||
+				req.Offset > uint64(s.Size) ||
+				uint64(req.Length) > uint64(s.Size)-req.Offset {
+				if err := write(conn, uint32(magicResponse), uint32(errInval), req.Handle); err != nil {
+					return err
+				}
+				continue
+			}
+			data := make([]byte, req.Length)
+			if _, err := s.Reader.ReadAt(data, int64(req.Offset)); err != nil && err != io.EOF {
+				log.Println("Error reading at", req.Offset, err)
+				if err := write(conn, uint32(magicResponse), uint32(errIO), req.Handle); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := write(conn, uint32(magicResponse), uint32(0), req.Handle); err != nil {
+				return err
+			}
+			if _, err := conn.Write(data); err != nil {
+				return err
+			}
+		case cmdWrite:
+			// Skip the data
+			if _, err := io.CopyN(ioutil.Discard, conn, int64(req.Length)); err != nil {
+				return err
+			}
+			if err := write(conn, uint32(magicResponse), uint32(errPerm), req.Handle); err != nil {
+				return err
+			}
+		case cmdDisc:
+			return nil
+		case cmdFlush:
+			if err := write(conn, uint32(magicResponse), uint32(0), req.Handle); err != nil {
+				return err
+			}
+		default:
+			if err := write(conn, uint32(magicResponse), uint32(errInval), req.Handle); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func reply(w io.Writer, option uint32, replyType uint32, data []byte) error {
+	if err := write(w, uint64(magicReply), option, replyType, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// write writes values big endian in one write.
+func write(w io.Writer, values ...interface{}) error {
+	var buf bytes.Buffer
+	for _, v := range values {
+		if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}